@@ -362,6 +362,56 @@ func TestIterateRange(t *testing.T) {
 	expectTraverse(t, trav, "low", "good", 2)
 }
 
+func TestRankQueries(t *testing.T) {
+	keys := []string{"abc", "fan", "foml", "foo", "foobang", "foobar", "foobaz", "food", "good", "low"}
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	require.EqualValues(t, -1, tree.IndexOf([]byte("abc")))
+	require.EqualValues(t, 0, tree.CountRange(nil, nil))
+
+	for i := len(keys) - 1; i >= 0; i-- {
+		tree.Set([]byte(keys[i]), []byte(keys[i]))
+	}
+
+	for i, key := range keys {
+		require.EqualValues(t, i, tree.IndexOf([]byte(key)))
+	}
+	require.EqualValues(t, -1, tree.IndexOf([]byte("fo")))
+	require.EqualValues(t, -1, tree.IndexOf([]byte("zzz")))
+
+	require.EqualValues(t, 10, tree.CountRange(nil, nil))
+	require.EqualValues(t, 5, tree.CountRange([]byte("foo"), []byte("goo")))
+	require.EqualValues(t, 3, tree.CountRange([]byte("fooba"), []byte("food")))
+	require.EqualValues(t, 2, tree.CountRange(nil, []byte("flap")))
+	require.EqualValues(t, 6, tree.CountRange([]byte("foob"), nil))
+	require.EqualValues(t, 0, tree.CountRange([]byte("very"), nil))
+	require.EqualValues(t, 0, tree.CountRange([]byte("low"), []byte("abc")))
+
+	trav := traverser{}
+	tree.IterateByIndex(0, 10, trav.view)
+	expectTraverse(t, trav, "abc", "low", 10)
+
+	trav = traverser{}
+	tree.IterateByIndex(3, 8, trav.view)
+	expectTraverse(t, trav, "foo", "food", 5)
+
+	trav = traverser{}
+	tree.IterateByIndex(9, 100, trav.view)
+	expectTraverse(t, trav, "low", "low", 1)
+
+	trav = traverser{}
+	tree.IterateByIndex(5, 5, trav.view)
+	expectTraverse(t, trav, "", "", 0)
+
+	// Iteration stops when the callback returns true.
+	count := 0
+	stopped := tree.IterateByIndex(2, 8, func(key, value []byte) bool {
+		count++
+		return count == 2
+	})
+	require.True(t, stopped)
+	require.Equal(t, 2, count)
+}
+
 func TestPersistence(t *testing.T) {
 	db := db.NewMemDB()
 
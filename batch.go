@@ -0,0 +1,64 @@
+package iavl
+
+import (
+	"bytes"
+	"sort"
+
+	cmn "github.com/tendermint/tendermint/libs/common"
+)
+
+// SetBatch sets many keys in the working tree, like ApplyBatch.
+func (tree *MutableTree) SetBatch(pairs []cmn.KVPair) error {
+	ops := make(ChangeSet, len(pairs))
+	for i, pair := range pairs {
+		ops[i] = KVChange{Key: pair.Key, Value: pair.Value}
+	}
+	return tree.ApplyBatch(ops)
+}
+
+// ApplyBatch applies many sets and removes to the working tree in one pass.
+// The operations are sorted by key before being applied, keeping the relative
+// order of the operations on the same key, and the inner nodes on the paths
+// they share are only cloned once. The resulting working tree is the same as
+// if the sorted operations had been applied one at a time with Set and Remove.
+//
+// Nothing is applied if any of the sets has a nil value, or, for a tree
+// loaded from a witness, if any of the nodes they read isn't available.
+func (tree *MutableTree) ApplyBatch(ops ChangeSet) (err error) {
+	for _, op := range ops {
+		if !op.Delete && op.Value == nil {
+			return cmn.NewError("nil value at key %X", op.Key)
+		}
+	}
+	if tree.ndb.partial {
+		root, changes := tree.root, tree.changes
+		orphans := make(map[string]int64, len(tree.orphans))
+		for hash, version := range tree.orphans {
+			orphans[hash] = version
+		}
+		defer func() {
+			if err != nil {
+				tree.root, tree.orphans, tree.changes = root, orphans, changes
+			}
+		}()
+		defer recoverNotAvailable(&err)
+	}
+
+	sorted := make(ChangeSet, len(ops))
+	copy(sorted, ops)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i].Key, sorted[j].Key) < 0
+	})
+
+	tree.batchNodes = map[*Node]struct{}{}
+	defer func() { tree.batchNodes = nil }()
+
+	for _, op := range sorted {
+		if op.Delete {
+			tree.Remove(op.Key)
+		} else {
+			tree.Set(op.Key, op.Value)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package iavl
+
+import (
+	"bytes"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	cmn "github.com/tendermint/tendermint/libs/common"
+	"github.com/tendermint/tendermint/libs/db"
+)
+
+func TestApplyBatch(t *testing.T) {
+	require := require.New(t)
+	r := rand.New(rand.NewSource(1))
+	batched := NewMutableTree(db.NewMemDB(), 0)
+	expected := NewMutableTree(db.NewMemDB(), 0)
+
+	for i := 0; i < 10; i++ {
+		ops := ChangeSet{}
+		for j := 0; j < 200; j++ {
+			key := []byte{byte(r.Intn(256)), byte(r.Intn(4))}
+			if r.Intn(4) == 0 {
+				ops = append(ops, KVChange{Key: key, Delete: true})
+			} else {
+				ops = append(ops, KVChange{Key: key, Value: []byte{byte(i), byte(j)}})
+			}
+		}
+		require.NoError(batched.ApplyBatch(ops))
+		require.Nil(batched.batchNodes)
+
+		sort.SliceStable(ops, func(i, j int) bool {
+			return bytes.Compare(ops[i].Key, ops[j].Key) < 0
+		})
+		for _, op := range ops {
+			if op.Delete {
+				expected.Remove(op.Key)
+			} else {
+				expected.Set(op.Key, op.Value)
+			}
+		}
+
+		require.Equal(expected.WorkingHash(), batched.WorkingHash())
+		require.Equal(expected.orphans, batched.orphans)
+		_, _, err := batched.SaveVersion()
+		require.NoError(err)
+		_, _, err = expected.SaveVersion()
+		require.NoError(err)
+		require.Equal(len(expected.ndb.nodes()), len(batched.ndb.nodes()))
+	}
+
+	// Saved versions aren't affected by later batches.
+	hash := batched.Hash()
+	require.NoError(batched.SetBatch([]cmn.KVPair{{Key: []byte{1}, Value: []byte{1}}}))
+	require.Equal(hash, batched.Hash())
+	require.Equal(hash, batched.ndb.getRoot(batched.Version()))
+}
+
+func TestApplyBatchNilValue(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	err := tree.ApplyBatch(ChangeSet{
+		{Key: []byte("a"), Value: []byte("a")},
+		{Key: []byte("b")},
+	})
+	require.Error(t, err)
+	require.True(t, tree.IsEmpty())
+}
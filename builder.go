@@ -0,0 +1,125 @@
+package iavl
+
+import (
+	"bytes"
+
+	cmn "github.com/tendermint/tendermint/libs/common"
+	dbm "github.com/tendermint/tendermint/libs/db"
+)
+
+// Number of nodes written to a batch by BuildMutableTree before it's
+// committed.
+const buildBatchSize = 10000
+
+// BuildMutableTree builds the first version of a tree in db, which must not
+// have any versions yet, from count key/value pairs read with next. The pairs
+// must be in strictly increasing key order. Once count pairs are read, next is
+// called once more and must return an error or a nil key, as there must be no
+// more pairs. The tree is built bottom-up into a
+// perfectly balanced tree, and its nodes are written straight to the database
+// instead of being inserted one at a time, which makes it a lot faster than
+// Set for large imports.
+//
+// The version is saved as Options.InitialVersion, or 1 if it isn't set. If an
+// error occurs, nodes may already have been written, and db should be
+// discarded.
+func BuildMutableTree(db dbm.DB, cacheSize int, opts *Options, count int64,
+	next func() (key, value []byte, err error)) (*MutableTree, error) {
+
+	tree := NewMutableTreeWithOpts(db, cacheSize, opts)
+	if count < 0 {
+		return nil, cmn.NewError("invalid count %d", count)
+	}
+	if latest := tree.ndb.getLatestVersion(); latest > 0 {
+		return nil, cmn.NewError("cannot build a tree in a database which has versions, latest is %d", latest)
+	}
+	version := tree.WorkingVersion()
+
+	if count == 0 {
+		tree.ndb.SaveEmptyRoot(version)
+	} else {
+		b := &treeBuilder{ndb: tree.ndb, version: version, next: next}
+		root, _, err := b.build(count)
+		if err != nil {
+			return nil, err
+		}
+		tree.ndb.SaveRoot(root, version)
+	}
+	if key, _, err := next(); err == nil && key != nil {
+		return nil, cmn.NewError("got more than %d pairs", count)
+	}
+	tree.ndb.Commit()
+
+	if _, err := tree.LoadVersion(version); err != nil {
+		return nil, err
+	}
+	return tree, nil
+}
+
+// treeBuilder writes the nodes built by BuildMutableTree.
+type treeBuilder struct {
+	ndb     *nodeDB
+	version int64
+	next    func() ([]byte, []byte, error)
+	lastKey []byte
+	pending int // Number of nodes written to the current batch.
+}
+
+// build reads size pairs and returns the root of the balanced subtree built
+// from them, along with its leftmost key. The returned node is hashed and
+// written, and doesn't reference its children.
+func (b *treeBuilder) build(size int64) (*Node, []byte, error) {
+	if size == 1 {
+		key, value, err := b.next()
+		if err != nil {
+			return nil, nil, err
+		}
+		if value == nil {
+			return nil, nil, cmn.NewError("nil value at key %X", key)
+		}
+		if b.lastKey != nil && bytes.Compare(key, b.lastKey) <= 0 {
+			return nil, nil, cmn.NewError("key %X isn't after the previous key %X", key, b.lastKey)
+		}
+		b.lastKey = key
+
+		node := NewNode(key, value, b.version)
+		b.write(node)
+		return node, key, nil
+	}
+
+	// The left subtree gets the extra pair, if any, so that the heights of
+	// the subtrees differ by at most one.
+	left, leftKey, err := b.build((size + 1) / 2)
+	if err != nil {
+		return nil, nil, err
+	}
+	right, rightKey, err := b.build(size / 2)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	node := &Node{
+		key:       rightKey,
+		version:   b.version,
+		height:    maxInt8(left.height, right.height) + 1,
+		size:      left.size + right.size,
+		leftHash:  left.hash,
+		rightHash: right.hash,
+	}
+	b.write(node)
+	return node, leftKey, nil
+}
+
+// write hashes the node and writes it to the batch, committing the batch once
+// it's big enough.
+func (b *treeBuilder) write(node *Node) {
+	node._hash()
+	b.ndb.writeNode(node)
+	node.persisted = true
+
+	b.pending++
+	if b.pending >= buildBatchSize {
+		b.ndb.Commit()
+		b.pending = 0
+	}
+}
@@ -0,0 +1,100 @@
+package iavl
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tendermint/tendermint/libs/db"
+)
+
+// sortedPairs returns a BuildMutableTree source for the given keys.
+func sortedPairs(keys [][]byte) func() ([]byte, []byte, error) {
+	i := 0
+	return func() ([]byte, []byte, error) {
+		if i >= len(keys) {
+			return nil, nil, fmt.Errorf("no more pairs")
+		}
+		key := keys[i]
+		i++
+		return key, append([]byte("v"), key...), nil
+	}
+}
+
+// requireBalanced checks that every node of the tree is AVL-balanced.
+func requireBalanced(t *testing.T, tree *ImmutableTree, node *Node) {
+	if node == nil || node.isLeaf() {
+		return
+	}
+	balance := node.calcBalance(tree)
+	require.True(t, balance >= -1 && balance <= 1, "node %X has balance %d", node.key, balance)
+	requireBalanced(t, tree, node.getLeftNode(tree))
+	requireBalanced(t, tree, node.getRightNode(tree))
+}
+
+func TestBuildMutableTree(t *testing.T) {
+	for _, count := range []int{0, 1, 2, 3, 7, 100, 1025} {
+		keys := make([][]byte, count)
+		for i := range keys {
+			keys[i] = []byte{byte(i >> 8), byte(i)}
+		}
+
+		tree, err := BuildMutableTree(db.NewMemDB(), 0, nil, int64(count), sortedPairs(keys))
+		require.NoError(t, err)
+		require.EqualValues(t, 1, tree.Version())
+		require.EqualValues(t, count, tree.Size())
+		requireBalanced(t, tree.ImmutableTree, tree.root)
+
+		// The built tree has the same contents as one built with Set.
+		expected := NewMutableTree(db.NewMemDB(), 0)
+		for _, key := range keys {
+			expected.Set(key, append([]byte("v"), key...))
+		}
+		for i, key := range keys {
+			idx, val := tree.Get(key)
+			require.EqualValues(t, i, idx)
+			_, expectedVal := expected.Get(key)
+			require.Equal(t, expectedVal, val)
+		}
+
+		// It can be modified like any other tree.
+		tree.Set([]byte("new"), []byte("new"))
+		tree.Set([]byte{0, byte(count / 2)}, []byte("updated"))
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+		require.NoError(t, tree.DeleteVersion(1))
+		require.Equal(t, tree.nodeSize(), len(tree.ndb.nodes()))
+	}
+}
+
+func TestBuildMutableTreeErrors(t *testing.T) {
+	keys := [][]byte{{1}, {2}, {2}}
+	_, err := BuildMutableTree(db.NewMemDB(), 0, nil, 3, sortedPairs(keys))
+	require.Error(t, err, "duplicate key")
+
+	keys = [][]byte{{1}, {3}, {2}}
+	_, err = BuildMutableTree(db.NewMemDB(), 0, nil, 3, sortedPairs(keys))
+	require.Error(t, err, "unsorted keys")
+
+	_, err = BuildMutableTree(db.NewMemDB(), 0, nil, 4, sortedPairs([][]byte{{1}, {2}, {3}}))
+	require.Error(t, err, "not enough pairs")
+
+	memDB := db.NewMemDB()
+	_, err = BuildMutableTree(memDB, 0, nil, 2, sortedPairs([][]byte{{1}, {2}, {3}}))
+	require.Error(t, err, "too many pairs")
+	require.Empty(t, NewMutableTree(memDB, 0).AvailableVersions())
+
+	memDB = db.NewMemDB()
+	_, err = BuildMutableTree(memDB, 0, &Options{InitialVersion: 10}, 3, sortedPairs(keys[:1]))
+	require.Error(t, err)
+	tree := NewMutableTree(memDB, 0)
+	tree.Set([]byte{1}, []byte{1})
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	_, err = BuildMutableTree(memDB, 0, nil, 1, sortedPairs([][]byte{{1}}))
+	require.Error(t, err, "database has versions")
+
+	built, err := BuildMutableTree(db.NewMemDB(), 0, &Options{InitialVersion: 10}, 1, sortedPairs([][]byte{{1}}))
+	require.NoError(t, err)
+	require.EqualValues(t, 10, built.Version())
+}
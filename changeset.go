@@ -0,0 +1,67 @@
+package iavl
+
+// KVChange is a single write made to the working tree by Set or Remove.
+type KVChange struct {
+	Key    []byte
+	Value  []byte // nil if Delete is set.
+	Delete bool
+}
+
+// ChangeSet is the ordered list of writes made to the working tree between
+// two saved versions.
+type ChangeSet []KVChange
+
+// ChangeSetListener is notified by MutableTree each time a version is saved.
+type ChangeSetListener interface {
+	// OnSaveVersion receives the version and root hash that were just saved,
+	// along with the writes made since the previous version. Writes discarded
+	// by Rollback aren't included. The listener must not modify changes.
+	//
+	// It is called once the version is on disk, which is on the background
+	// writer if Options.AsyncCommit is set. An error is returned by
+	// SaveVersion, or by Flush with Options.AsyncCommit, though the version
+	// remains saved.
+	OnSaveVersion(version int64, rootHash []byte, changes ChangeSet) error
+}
+
+// AddListener registers a listener which is notified of the changes saved by
+// SaveVersion. Only the writes made after the first listener was added are
+// tracked.
+func (tree *MutableTree) AddListener(listener ChangeSetListener) {
+	tree.listeners = append(tree.listeners, listener)
+}
+
+// recordChange tracks a write for the listeners, if there are any.
+func (tree *MutableTree) recordChange(change KVChange) {
+	if len(tree.listeners) == 0 {
+		return
+	}
+	change.Key = cp(change.Key)
+	if change.Value != nil {
+		change.Value = cp(change.Value)
+	}
+	tree.changes = append(tree.changes, change)
+}
+
+// notifyListeners hands the tracked writes over to the listeners, once the
+// version is written to disk. With Options.AsyncCommit, the listeners are
+// notified by the background writer, and aren't if the write fails.
+func (tree *MutableTree) notifyListeners(version int64, rootHash []byte) error {
+	if len(tree.listeners) == 0 {
+		return nil
+	}
+	listeners, changes := tree.listeners, tree.changes
+	tree.changes = nil
+	notify := func() error {
+		for _, listener := range listeners {
+			if err := listener.OnSaveVersion(version, rootHash, changes); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if tree.ndb.opts.AsyncCommit {
+		return tree.ndb.afterWrites(notify)
+	}
+	return notify()
+}
@@ -0,0 +1,222 @@
+package iavl
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"sync"
+
+	"github.com/tendermint/go-amino"
+	cmn "github.com/tendermint/tendermint/libs/common"
+	dbm "github.com/tendermint/tendermint/libs/db"
+)
+
+// Change sets are indexed in the log database by the version they produced.
+var changeSetKeyFormat = NewKeyFormat('l', int64Size) // l<version>
+
+// ChangeSetLog is an append-only log of the change sets saved by a
+// MutableTree, along with the root hash of each version. It is kept in its own
+// database, and can rebuild any version of the tree with Replay, even after
+// the version was pruned from the tree.
+//
+// The log is attached to a tree with AddListener, and must be attached before
+// the first version of the tree is saved for Replay to work.
+type ChangeSetLog struct {
+	mtx           sync.Mutex
+	db            dbm.DB
+	latestVersion int64
+}
+
+// NewChangeSetLog returns a change set log stored in db, which may already
+// contain a log.
+func NewChangeSetLog(db dbm.DB) *ChangeSetLog {
+	log := &ChangeSetLog{db: db}
+
+	itr := db.ReverseIterator(
+		changeSetKeyFormat.Key(int64(1)),
+		changeSetKeyFormat.Key(int64(math.MaxInt64)),
+	)
+	defer itr.Close()
+	if itr.Valid() {
+		changeSetKeyFormat.Scan(itr.Key(), &log.latestVersion)
+	}
+	return log
+}
+
+// OnSaveVersion implements ChangeSetListener. It fails if the change set
+// can't be appended, since the log would no longer match the tree.
+func (log *ChangeSetLog) OnSaveVersion(version int64, rootHash []byte, changes ChangeSet) error {
+	return log.append(version, rootHash, changes)
+}
+
+// LatestVersion returns the latest version in the log, or 0 if it's empty.
+func (log *ChangeSetLog) LatestVersion() int64 {
+	log.mtx.Lock()
+	defer log.mtx.Unlock()
+	return log.latestVersion
+}
+
+// Get returns the root hash and change set logged for version.
+func (log *ChangeSetLog) Get(version int64) ([]byte, ChangeSet, error) {
+	buf := log.db.Get(changeSetKeyFormat.Key(version))
+	if buf == nil {
+		return nil, nil, cmn.NewError("no change set logged for version %d", version)
+	}
+	return decodeChangeSetEntry(buf)
+}
+
+func (log *ChangeSetLog) append(version int64, rootHash []byte, changes ChangeSet) error {
+	log.mtx.Lock()
+	defer log.mtx.Unlock()
+
+	if version <= log.latestVersion {
+		// Saving an existing version again with the same hash is a no-op.
+		existing, _, err := log.Get(version)
+		if err == nil && bytes.Equal(existing, rootHash) {
+			return nil
+		}
+		return cmn.NewError("cannot log version %d, must be after the latest logged version %d",
+			version, log.latestVersion)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := writeChangeSetEntry(buf, rootHash, changes); err != nil {
+		return err
+	}
+	log.db.SetSync(changeSetKeyFormat.Key(version), buf.Bytes())
+	log.latestVersion = version
+	return nil
+}
+
+// Replay rebuilds versions fromVersion through toVersion in a fresh
+// MutableTree stored in db, which must be empty. All logged change sets up to
+// toVersion are applied in order, and the root hash of each saved version is
+// checked against the logged one. Versions before fromVersion are deleted as
+// the replay moves past them.
+//
+// Each version is saved with SaveVersionAt, which gives the nodes it creates
+// the version of the log entry, as in the logged tree.
+func (log *ChangeSetLog) Replay(db dbm.DB, fromVersion, toVersion int64) (*MutableTree, error) {
+	if fromVersion < 1 || toVersion < fromVersion {
+		return nil, cmn.NewError("invalid version range %d to %d", fromVersion, toVersion)
+	}
+	tree := NewMutableTree(db, 0)
+	if len(tree.AvailableVersions()) > 0 {
+		return nil, cmn.NewError("cannot replay into a database which already has versions")
+	}
+
+	itr := log.db.Iterator(changeSetKeyFormat.Key(int64(1)), changeSetKeyFormat.Key(toVersion+1))
+	defer itr.Close()
+	for ; itr.Valid(); itr.Next() {
+		var version int64
+		changeSetKeyFormat.Scan(itr.Key(), &version)
+		logged, changes, cerr := decodeChangeSetEntry(itr.Value())
+		if cerr != nil {
+			return nil, cmn.ErrorWrap(cerr, "decoding change set")
+		}
+
+		for _, change := range changes {
+			if change.Delete {
+				tree.Remove(change.Key)
+			} else {
+				tree.Set(change.Key, change.Value)
+			}
+		}
+		previous := tree.Version()
+		hash, _, err := tree.SaveVersionAt(version)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(hash, logged) {
+			return nil, cmn.NewError("replayed version %d has root hash %X, logged hash is %X",
+				version, hash, logged)
+		}
+		if previous > 0 && previous < fromVersion {
+			if err := tree.DeleteVersion(previous); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if tree.Version() < fromVersion {
+		return nil, cmn.NewError("no change sets logged from version %d to %d", fromVersion, toVersion)
+	}
+	return tree, nil
+}
+
+// Writes a logged root hash and change set to the supplied io.Writer.
+func writeChangeSetEntry(w io.Writer, rootHash []byte, changes ChangeSet) cmn.Error {
+	cause := amino.EncodeByteSlice(w, rootHash)
+	if cause != nil {
+		return cmn.ErrorWrap(cause, "writing root hash")
+	}
+	cause = amino.EncodeUvarint(w, uint64(len(changes)))
+	if cause != nil {
+		return cmn.ErrorWrap(cause, "writing change count")
+	}
+	for _, change := range changes {
+		cause = amino.EncodeBool(w, change.Delete)
+		if cause != nil {
+			return cmn.ErrorWrap(cause, "writing change type")
+		}
+		cause = amino.EncodeByteSlice(w, change.Key)
+		if cause != nil {
+			return cmn.ErrorWrap(cause, "writing key")
+		}
+		if change.Delete {
+			continue
+		}
+		cause = amino.EncodeByteSlice(w, change.Value)
+		if cause != nil {
+			return cmn.ErrorWrap(cause, "writing value")
+		}
+	}
+	return nil
+}
+
+// decodeChangeSetEntry decodes a logged root hash and change set.
+func decodeChangeSetEntry(buf []byte) ([]byte, ChangeSet, cmn.Error) {
+	rootHash, n, cause := amino.DecodeByteSlice(buf)
+	if cause != nil {
+		return nil, nil, cmn.ErrorWrap(cause, "decoding root hash")
+	}
+	buf = buf[n:]
+
+	count, n, cause := amino.DecodeUvarint(buf)
+	if cause != nil {
+		return nil, nil, cmn.ErrorWrap(cause, "decoding change count")
+	}
+	buf = buf[n:]
+	if count > uint64(len(buf)) {
+		return nil, nil, cmn.NewError("invalid change count %d", count)
+	}
+
+	changes := make(ChangeSet, 0, count)
+	for i := uint64(0); i < count; i++ {
+		var change KVChange
+		change.Delete, n, cause = amino.DecodeBool(buf)
+		if cause != nil {
+			return nil, nil, cmn.ErrorWrap(cause, "decoding change type")
+		}
+		buf = buf[n:]
+
+		change.Key, n, cause = amino.DecodeByteSlice(buf)
+		if cause != nil {
+			return nil, nil, cmn.ErrorWrap(cause, "decoding key")
+		}
+		buf = buf[n:]
+
+		if !change.Delete {
+			change.Value, n, cause = amino.DecodeByteSlice(buf)
+			if cause != nil {
+				return nil, nil, cmn.ErrorWrap(cause, "decoding value")
+			}
+			if change.Value == nil {
+				change.Value = []byte{}
+			}
+			buf = buf[n:]
+		}
+		changes = append(changes, change)
+	}
+	return rootHash, changes, nil
+}
@@ -0,0 +1,196 @@
+package iavl
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tendermint/tendermint/libs/db"
+)
+
+type savedChangeSet struct {
+	version  int64
+	rootHash []byte
+	changes  ChangeSet
+}
+
+type recordingListener struct {
+	saved []savedChangeSet
+}
+
+func (l *recordingListener) OnSaveVersion(version int64, rootHash []byte, changes ChangeSet) error {
+	l.saved = append(l.saved, savedChangeSet{version, rootHash, changes})
+	return nil
+}
+
+func TestChangeSetListener(t *testing.T) {
+	require := require.New(t)
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	listener := &recordingListener{}
+	tree.AddListener(listener)
+
+	tree.Set([]byte("a"), []byte("1"))
+	tree.Set([]byte("b"), []byte("2"))
+	tree.Set([]byte("a"), []byte("3"))
+	tree.Remove([]byte("c")) // Doesn't exist, not recorded.
+	hash, version, err := tree.SaveVersion()
+	require.NoError(err)
+
+	require.Len(listener.saved, 1)
+	require.Equal(version, listener.saved[0].version)
+	require.Equal(hash, listener.saved[0].rootHash)
+	require.Equal(ChangeSet{
+		{Key: []byte("a"), Value: []byte("1")},
+		{Key: []byte("b"), Value: []byte("2")},
+		{Key: []byte("a"), Value: []byte("3")},
+	}, listener.saved[0].changes)
+
+	// Rolled back changes aren't reported.
+	tree.Set([]byte("x"), []byte("x"))
+	tree.Rollback()
+	tree.Remove([]byte("b"))
+	hash, version, err = tree.SaveVersion()
+	require.NoError(err)
+
+	require.Len(listener.saved, 2)
+	require.Equal(savedChangeSet{version, hash, ChangeSet{
+		{Key: []byte("b"), Delete: true},
+	}}, listener.saved[1])
+
+	// Merged forks report their changes.
+	fork := tree.Fork()
+	fork.Set([]byte("f"), []byte("f"))
+	require.NoError(tree.Merge(fork))
+	_, _, err = tree.SaveVersion()
+	require.NoError(err)
+
+	require.Len(listener.saved, 3)
+	require.Equal(ChangeSet{{Key: []byte("f"), Value: []byte("f")}}, listener.saved[2].changes)
+
+	// Empty versions are reported too.
+	_, _, err = tree.SaveVersion()
+	require.NoError(err)
+	require.Len(listener.saved, 4)
+	require.Empty(listener.saved[3].changes)
+
+	// The changes don't share the caller's buffers.
+	key, value := []byte("k"), []byte("v")
+	tree.Set(key, value)
+	key[0], value[0] = 'x', 'x'
+	_, _, err = tree.SaveVersion()
+	require.NoError(err)
+	require.Equal(ChangeSet{{Key: []byte("k"), Value: []byte("v")}}, listener.saved[4].changes)
+
+	// Listeners added to a fork or its parent aren't shared.
+	tree.AddListener(&recordingListener{})
+	tree.AddListener(&recordingListener{})
+	fork = tree.Fork()
+	forkListener, treeListener := &recordingListener{}, &recordingListener{}
+	fork.AddListener(forkListener)
+	tree.AddListener(treeListener)
+	require.True(fork.listeners[len(fork.listeners)-1] == forkListener)
+	require.True(tree.listeners[len(tree.listeners)-1] == treeListener)
+}
+
+func TestChangeSetLogReplay(t *testing.T) {
+	require := require.New(t)
+	logDB := db.NewMemDB()
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	tree.AddListener(NewChangeSetLog(logDB))
+
+	hashes := map[int64][]byte{}
+	for i := 0; i < 10; i++ {
+		for j := 0; j < 20; j++ {
+			tree.Set([]byte{byte(j)}, []byte{byte(i), byte(j)})
+		}
+		tree.Remove([]byte{byte(i)})
+		tree.Set([]byte("empty"), []byte{})
+		hash, version, err := tree.SaveVersionAt(int64(2*i + 1))
+		require.NoError(err)
+		hashes[version] = hash
+	}
+	// Prune the tree, the log still has every version.
+	for v := int64(1); v < tree.Version(); v += 2 {
+		require.NoError(tree.DeleteVersion(v))
+	}
+
+	log := NewChangeSetLog(logDB)
+	require.EqualValues(19, log.LatestVersion())
+
+	replayed, err := log.Replay(db.NewMemDB(), 5, 12)
+	require.NoError(err)
+	require.Equal([]int64{5, 7, 9, 11}, replayed.AvailableVersions())
+	for _, v := range replayed.AvailableVersions() {
+		require.Equal(hashes[v], replayed.ndb.getRoot(v))
+	}
+
+	_, err = log.Replay(db.NewMemDB(), 20, 30)
+	require.Error(err)
+	_, err = log.Replay(replayed.ndb.db, 1, 3)
+	require.Error(err, "database isn't empty")
+
+	// A tampered log is detected.
+	rootHash, changes, err := log.Get(3)
+	require.NoError(err)
+	changes[0].Value = []byte("tampered")
+	buf := new(bytes.Buffer)
+	require.NoError(writeChangeSetEntry(buf, rootHash, changes))
+	logDB.Set(changeSetKeyFormat.Key(int64(3)), buf.Bytes())
+
+	_, err = log.Replay(db.NewMemDB(), 1, 1)
+	require.NoError(err)
+	_, err = log.Replay(db.NewMemDB(), 1, 3)
+	require.Error(err)
+}
+
+func TestChangeSetLogReplayInitialVersion(t *testing.T) {
+	require := require.New(t)
+
+	// Trees which start at a later version, as their initial version, by
+	// skipping to it, or by skipping past their initial version.
+	for _, opts := range []*Options{{InitialVersion: 1000}, nil, {InitialVersion: 10}} {
+		logDB := db.NewMemDB()
+		tree := NewMutableTreeWithOpts(db.NewMemDB(), 0, opts)
+		tree.AddListener(NewChangeSetLog(logDB))
+		for i := 0; i < 3; i++ {
+			for j := 0; j < 10; j++ {
+				tree.Set([]byte{byte(i), byte(j)}, []byte{byte(j)})
+			}
+			_, _, err := tree.SaveVersionAt(int64(1000 + i))
+			require.NoError(err)
+		}
+
+		replayed, err := NewChangeSetLog(logDB).Replay(db.NewMemDB(), 1000, 1002)
+		require.NoError(err)
+		require.Equal([]int64{1000, 1001, 1002}, replayed.AvailableVersions())
+		require.Equal(tree.Hash(), replayed.Hash())
+	}
+}
+
+func TestChangeSetLogError(t *testing.T) {
+	require := require.New(t)
+	logDB := db.NewMemDB()
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	tree.AddListener(NewChangeSetLog(logDB))
+	tree.Set([]byte("a"), []byte{1})
+	_, _, err := tree.SaveVersion()
+	require.NoError(err)
+
+	// A log which can't be appended to makes SaveVersion fail, though the
+	// version is saved.
+	other := NewMutableTree(db.NewMemDB(), 0)
+	other.AddListener(NewChangeSetLog(logDB))
+	other.Set([]byte("b"), []byte{2})
+	_, _, err = other.SaveVersion()
+	require.Error(err)
+	require.EqualValues(1, other.Version())
+
+	// With AsyncCommit, the error is reported by Flush.
+	other = NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{AsyncCommit: true})
+	other.AddListener(NewChangeSetLog(logDB))
+	other.Set([]byte("b"), []byte{2})
+	_, _, err = other.SaveVersion()
+	require.NoError(err)
+	require.Error(other.Flush())
+	require.True(other.VersionExists(1))
+}
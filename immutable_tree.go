@@ -3,6 +3,7 @@ package iavl
 import (
 	"fmt"
 	"strings"
+	"sync/atomic"
 
 	dbm "github.com/tendermint/tendermint/libs/db"
 )
@@ -14,6 +15,11 @@ type ImmutableTree struct {
 	root    *Node
 	ndb     *nodeDB
 	version int64
+
+	// Holds the *nodeTrace recording the nodes read through the tree, if
+	// any. It is accessed atomically, as tracing may start and stop while
+	// the tree is read.
+	trace atomic.Value
 }
 
 // NewImmutableTree creates both in-memory and persistent instances
@@ -24,7 +30,7 @@ func NewImmutableTree(db dbm.DB, cacheSize int) *ImmutableTree {
 	}
 	return &ImmutableTree{
 		// NodeDB-backed Tree.
-		ndb: newNodeDB(db, cacheSize),
+		ndb: newNodeDB(db, cacheSize, DefaultOptions()),
 	}
 }
 
@@ -101,6 +107,46 @@ func (t *ImmutableTree) GetByIndex(index int64) (key []byte, value []byte) {
 	return t.root.getByIndex(t, index)
 }
 
+// IndexOf returns the index of key in the tree, or -1 if it doesn't exist.
+func (t *ImmutableTree) IndexOf(key []byte) int64 {
+	if t.root == nil {
+		return -1
+	}
+	index, value := t.root.get(t, key)
+	if value == nil {
+		return -1
+	}
+	return index
+}
+
+// CountRange returns the number of keys between start and end non-inclusive,
+// without iterating over them. If either are nil, then it is open on that side.
+func (t *ImmutableTree) CountRange(start, end []byte) int64 {
+	if t.root == nil {
+		return 0
+	}
+	var from, to int64 = 0, t.root.size
+	if start != nil {
+		from, _ = t.root.get(t, start)
+	}
+	if end != nil {
+		to, _ = t.root.get(t, end)
+	}
+	if to < from {
+		return 0
+	}
+	return to - from
+}
+
+// IterateByIndex makes a callback for the keys with an index between from
+// inclusive and to non-inclusive, in order.
+func (t *ImmutableTree) IterateByIndex(from, to int64, fn func(key []byte, value []byte) bool) (stopped bool) {
+	if t.root == nil {
+		return false
+	}
+	return t.root.iterateByIndex(t, from, to, fn)
+}
+
 // Iterate iterates over all keys of the tree, in order.
 func (t *ImmutableTree) Iterate(fn func(key []byte, value []byte) bool) (stopped bool) {
 	if t.root == nil {
@@ -145,11 +191,13 @@ func (t *ImmutableTree) IterateRangeInclusive(start, end []byte, ascending bool,
 // Clone creates a clone of the tree.
 // Used internally by MutableTree.
 func (t *ImmutableTree) clone() *ImmutableTree {
-	return &ImmutableTree{
+	clone := &ImmutableTree{
 		root:    t.root,
 		ndb:     t.ndb,
 		version: t.version,
 	}
+	clone.setTrace(t.getTrace())
+	return clone
 }
 
 // nodeSize is like Size, but includes inner nodes too.
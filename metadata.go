@@ -0,0 +1,143 @@
+package iavl
+
+import (
+	"bytes"
+	"io"
+	"time"
+
+	"github.com/tendermint/go-amino"
+	cmn "github.com/tendermint/tendermint/libs/common"
+)
+
+// VersionMetadata is attached to a version with SaveVersionWithMetadata.
+type VersionMetadata struct {
+	Time   time.Time // Time at which the version was committed, may be zero.
+	Height int64     // Block height of the version, may differ from the version.
+	Data   []byte    // Arbitrary application data.
+}
+
+// Writes the metadata as a serialized byte slice to the supplied io.Writer.
+func (meta *VersionMetadata) writeBytes(w io.Writer) cmn.Error {
+	var nanos int64
+	if !meta.Time.IsZero() {
+		nanos = meta.Time.UnixNano()
+	}
+	cause := amino.EncodeVarint(w, nanos)
+	if cause != nil {
+		return cmn.ErrorWrap(cause, "writing time")
+	}
+	cause = amino.EncodeVarint(w, meta.Height)
+	if cause != nil {
+		return cmn.ErrorWrap(cause, "writing height")
+	}
+	cause = amino.EncodeByteSlice(w, meta.Data)
+	if cause != nil {
+		return cmn.ErrorWrap(cause, "writing data")
+	}
+	return nil
+}
+
+// timeIndexed returns whether the version is found by VersionAtTime, which
+// ignores missing times and times before the Unix epoch.
+func (meta *VersionMetadata) timeIndexed() bool {
+	return !meta.Time.IsZero() && meta.Time.UnixNano() >= 0
+}
+
+// makeVersionMetadata constructs a *VersionMetadata from an encoded byte slice.
+func makeVersionMetadata(buf []byte) (*VersionMetadata, cmn.Error) {
+	nanos, n, cause := amino.DecodeVarint(buf)
+	if cause != nil {
+		return nil, cmn.ErrorWrap(cause, "decoding metadata.time")
+	}
+	buf = buf[n:]
+
+	height, n, cause := amino.DecodeVarint(buf)
+	if cause != nil {
+		return nil, cmn.ErrorWrap(cause, "decoding metadata.height")
+	}
+	buf = buf[n:]
+
+	data, _, cause := amino.DecodeByteSlice(buf)
+	if cause != nil {
+		return nil, cmn.ErrorWrap(cause, "decoding metadata.data")
+	}
+
+	meta := &VersionMetadata{
+		Height: height,
+		Data:   data,
+	}
+	if nanos != 0 {
+		meta.Time = time.Unix(0, nanos).UTC()
+	}
+	return meta, nil
+}
+
+func (meta *VersionMetadata) bytes() []byte {
+	buf := new(bytes.Buffer)
+	if err := meta.writeBytes(buf); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+//----------------------------------------
+
+// SaveVersionWithMetadata is like SaveVersion, and attaches meta to the new
+// version. The metadata is deleted along with the version.
+func (tree *MutableTree) SaveVersionWithMetadata(meta VersionMetadata) ([]byte, int64, error) {
+	return tree.saveVersion(tree.WorkingVersion(), &meta)
+}
+
+// GetVersionMetadata returns the metadata attached to a version, or nil if
+// it was saved without metadata.
+func (tree *MutableTree) GetVersionMetadata(version int64) (*VersionMetadata, error) {
+	if !tree.VersionExists(version) {
+		return nil, cmn.ErrorWrap(ErrVersionDoesNotExist, "")
+	}
+	return tree.ndb.getVersionMetadata(version)
+}
+
+// VersionAtTime returns the latest existing version whose metadata time is at
+// or before t, or 0 if there is none. Versions saved without a time are
+// ignored, as are times before the Unix epoch.
+func (tree *MutableTree) VersionAtTime(t time.Time) int64 {
+	return tree.ndb.getVersionAtTime(t)
+}
+
+//----------------------------------------
+
+// PinVersion pins a version under a checkpoint name, so that it can't be
+// deleted until it is unpinned. Pinning a name again moves the checkpoint.
+func (tree *MutableTree) PinVersion(name string, version int64) error {
+	if name == "" {
+		return cmn.NewError("checkpoint name must not be empty")
+	}
+	if !tree.VersionExists(version) {
+		return cmn.ErrorWrap(ErrVersionDoesNotExist, "")
+	}
+	return tree.ndb.saveCheckpoint(name, version)
+}
+
+// UnpinVersion removes a checkpoint created with PinVersion. The version can
+// be deleted again unless another checkpoint pins it.
+func (tree *MutableTree) UnpinVersion(name string) error {
+	if _, ok := tree.ndb.getCheckpoints()[name]; !ok {
+		return cmn.NewError("checkpoint %q does not exist", name)
+	}
+	return tree.ndb.deleteCheckpoint(name)
+}
+
+// Checkpoints returns the pinned versions by checkpoint name.
+func (tree *MutableTree) Checkpoints() map[string]int64 {
+	return tree.ndb.getCheckpoints()
+}
+
+// checkNotPinned returns an error if the version is pinned by a checkpoint.
+func (tree *MutableTree) checkNotPinned(version int64) error {
+	for name, pinned := range tree.ndb.getCheckpoints() {
+		if pinned == version {
+			return cmn.NewError("version %d is pinned by checkpoint %q", version, name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package iavl
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tendermint/tendermint/libs/db"
+)
+
+func TestVersionMetadata(t *testing.T) {
+	require := require.New(t)
+
+	mdb := db.NewMemDB()
+	tree := NewMutableTree(mdb, 0)
+	start := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for i := 1; i <= 10; i++ {
+		tree.Set([]byte{byte(i)}, []byte{byte(i)})
+		var err error
+		if i == 5 {
+			_, _, err = tree.SaveVersion()
+		} else {
+			_, _, err = tree.SaveVersionWithMetadata(VersionMetadata{
+				Time:   start.Add(time.Duration(i) * time.Minute),
+				Height: int64(i) + 1000,
+				Data:   []byte{0xAA, byte(i)},
+			})
+		}
+		require.NoError(err)
+	}
+
+	meta, err := tree.GetVersionMetadata(3)
+	require.NoError(err)
+	require.Equal(&VersionMetadata{
+		Time:   start.Add(3 * time.Minute),
+		Height: 1003,
+		Data:   []byte{0xAA, 3},
+	}, meta)
+
+	meta, err = tree.GetVersionMetadata(5)
+	require.NoError(err)
+	require.Nil(meta)
+
+	_, err = tree.GetVersionMetadata(11)
+	require.Error(err)
+
+	require.EqualValues(0, tree.VersionAtTime(start))
+	require.EqualValues(1, tree.VersionAtTime(start.Add(time.Minute)))
+	require.EqualValues(3, tree.VersionAtTime(start.Add(3*time.Minute+time.Second)))
+	require.EqualValues(4, tree.VersionAtTime(start.Add(5*time.Minute)))
+	require.EqualValues(10, tree.VersionAtTime(start.Add(time.Hour)))
+
+	// Metadata is deleted along with its version.
+	require.NoError(tree.DeleteVersion(3))
+	require.EqualValues(2, tree.VersionAtTime(start.Add(3*time.Minute+time.Second)))
+	require.Nil(mdb.Get(metadataKeyFormat.Key(int64(3))))
+
+	// The metadata is persisted.
+	tree = NewMutableTree(mdb, 0)
+	_, err = tree.Load()
+	require.NoError(err)
+	meta, err = tree.GetVersionMetadata(10)
+	require.NoError(err)
+	require.EqualValues(1010, meta.Height)
+	require.EqualValues(10, tree.VersionAtTime(start.Add(time.Hour)))
+
+	// Times before the Unix epoch aren't indexed.
+	tree.Set([]byte{11}, []byte{11})
+	_, _, err = tree.SaveVersionWithMetadata(VersionMetadata{Time: time.Unix(-60, 0)})
+	require.NoError(err)
+	meta, err = tree.GetVersionMetadata(11)
+	require.NoError(err)
+	require.Equal(int64(-60), meta.Time.Unix())
+	itr := mdb.Iterator(metadataTimeKeyFormat.Key(), metadataTimeKeyFormat.Key(int64(0)))
+	require.False(itr.Valid())
+	itr.Close()
+	require.EqualValues(10, tree.VersionAtTime(start.Add(time.Hour)))
+}
+
+func TestVersionMetadataAsync(t *testing.T) {
+	require := require.New(t)
+
+	tree := NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{AsyncCommit: true})
+	now := time.Now().UTC()
+
+	tree.Set([]byte("k"), []byte("v"))
+	_, version, err := tree.SaveVersionWithMetadata(VersionMetadata{Time: now, Height: 7})
+	require.NoError(err)
+
+	meta, err := tree.GetVersionMetadata(version)
+	require.NoError(err)
+	require.EqualValues(7, meta.Height)
+	require.Equal(version, tree.VersionAtTime(now))
+
+	require.NoError(tree.Close())
+	meta, err = tree.GetVersionMetadata(version)
+	require.NoError(err)
+	require.Equal(now, meta.Time)
+}
+
+func TestCheckpoints(t *testing.T) {
+	require := require.New(t)
+
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	for i := 1; i <= 5; i++ {
+		tree.Set([]byte{byte(i)}, []byte{byte(i)})
+		_, _, err := tree.SaveVersion()
+		require.NoError(err)
+	}
+
+	require.Error(tree.PinVersion("upgrade", 6), "version doesn't exist")
+	require.Error(tree.PinVersion("", 2), "empty name")
+	require.NoError(tree.PinVersion("upgrade", 2))
+	require.NoError(tree.PinVersion("genesis", 1))
+	require.Equal(map[string]int64{"upgrade": 2, "genesis": 1}, tree.Checkpoints())
+
+	// Pinned versions survive pruning.
+	for v := int64(1); v < 5; v++ {
+		err := tree.DeleteVersion(v)
+		if v <= 2 {
+			require.Error(err)
+		} else {
+			require.NoError(err)
+		}
+	}
+	require.Equal([]int64{1, 2, 5}, tree.AvailableVersions())
+	_, val := tree.GetVersioned([]byte{2}, 2)
+	require.Equal([]byte{2}, val)
+
+	// Moving a checkpoint releases the previous version.
+	require.NoError(tree.PinVersion("upgrade", 5))
+	require.NoError(tree.DeleteVersion(2))
+
+	require.Error(tree.UnpinVersion("missing"))
+	require.NoError(tree.UnpinVersion("genesis"))
+	require.NoError(tree.DeleteVersion(1))
+	require.Equal([]int64{5}, tree.AvailableVersions())
+	require.Equal(tree.nodeSize(), len(tree.ndb.nodes()))
+
+	// Overwriting fails rather than delete a pinned version.
+	for i := 6; i <= 7; i++ {
+		tree.Set([]byte{byte(i)}, []byte{byte(i)})
+		_, _, err := tree.SaveVersion()
+		require.NoError(err)
+	}
+	require.NoError(tree.PinVersion("upgrade", 7))
+	_, err := tree.LoadVersionForOverwriting(5)
+	require.Error(err)
+	require.Equal([]int64{5, 6, 7}, tree.AvailableVersions())
+	require.NoError(tree.UnpinVersion("upgrade"))
+	_, err = tree.LoadVersionForOverwriting(5)
+	require.NoError(err)
+	require.Equal([]int64{5}, tree.AvailableVersions())
+	tree.Set([]byte{6}, []byte{6})
+	_, _, err = tree.SaveVersion()
+	require.NoError(err)
+
+	// With AsyncCommit, checkpoints take effect right away, but are written
+	// after the versions they pin.
+	fdb := &failingDB{DB: db.NewMemDB(), block: make(chan struct{})}
+	tree = NewMutableTreeWithOpts(fdb, 0, &Options{AsyncCommit: true})
+	for i := 1; i <= 2; i++ {
+		tree.Set([]byte{byte(i)}, []byte{byte(i)})
+		_, _, err = tree.SaveVersion()
+		require.NoError(err)
+	}
+	require.NoError(tree.PinVersion("first", 1))
+	require.Error(tree.DeleteVersion(1))
+	require.Equal(map[string]int64{"first": 1}, tree.Checkpoints())
+	disk := NewMutableTree(fdb.DB, 0)
+	require.Empty(disk.Checkpoints())
+	require.Empty(disk.AvailableVersions())
+
+	close(fdb.block)
+	require.NoError(tree.Flush())
+	disk = NewMutableTree(fdb.DB, 0)
+	require.Equal(map[string]int64{"first": 1}, disk.Checkpoints())
+	require.Equal([]int64{1, 2}, disk.AvailableVersions())
+}
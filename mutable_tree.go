@@ -16,20 +16,37 @@ type MutableTree struct {
 	*ImmutableTree                  // The current, working tree.
 	lastSaved      *ImmutableTree   // The most recently saved tree.
 	orphans        map[string]int64 // Nodes removed by changes to working tree.
-	versions       map[int64]bool   // The previous, saved versions of the tree.
 	ndb            *nodeDB
+
+	// Inner nodes created by the batch being applied, which can be modified
+	// in place. Nil outside of ApplyBatch.
+	batchNodes map[*Node]struct{}
+
+	listeners []ChangeSetListener // Notified of the changes saved by SaveVersion.
+	changes   ChangeSet           // Changes made to the working tree, if there are listeners.
+
+	forkedFrom *MutableTree   // The tree this tree was forked from, if any.
+	forkBase   *ImmutableTree // The parent's working tree at the time of the fork.
 }
 
 // NewMutableTree returns a new tree with the specified cache size and datastore.
 func NewMutableTree(db dbm.DB, cacheSize int) *MutableTree {
-	ndb := newNodeDB(db, cacheSize)
+	return NewMutableTreeWithOpts(db, cacheSize, nil)
+}
+
+// NewMutableTreeWithOpts returns a new tree with the specified cache size,
+// datastore and options. If opts is nil, DefaultOptions are used.
+func NewMutableTreeWithOpts(db dbm.DB, cacheSize int, opts *Options) *MutableTree {
+	if opts == nil {
+		opts = DefaultOptions()
+	}
+	ndb := newNodeDB(db, cacheSize, opts)
 	head := &ImmutableTree{ndb: ndb}
 
 	return &MutableTree{
 		ImmutableTree: head,
 		lastSaved:     head.clone(),
 		orphans:       map[string]int64{},
-		versions:      map[int64]bool{},
 		ndb:           ndb,
 	}
 }
@@ -42,7 +59,13 @@ func (tree *MutableTree) IsEmpty() bool {
 
 // VersionExists returns whether or not a version exists.
 func (tree *MutableTree) VersionExists(version int64) bool {
-	return tree.versions[version]
+	return tree.ndb.getRoot(version) != nil
+}
+
+// AvailableVersions returns all the saved versions of the tree, in ascending
+// order.
+func (tree *MutableTree) AvailableVersions() []int64 {
+	return tree.ndb.getVersions()
 }
 
 // Hash returns the hash of the latest saved version of the tree, as returned
@@ -68,6 +91,7 @@ func (tree *MutableTree) String() string {
 func (tree *MutableTree) Set(key, value []byte) bool {
 	orphaned, updated := tree.set(key, value)
 	tree.addOrphans(orphaned)
+	tree.recordChange(KVChange{Key: key, Value: value})
 	return updated
 }
 
@@ -76,7 +100,7 @@ func (tree *MutableTree) set(key []byte, value []byte) (orphaned []*Node, update
 		panic(fmt.Sprintf("Attempt to store nil value at key '%s'", key))
 	}
 	if tree.ImmutableTree.root == nil {
-		tree.ImmutableTree.root = NewNode(key, value, tree.version+1)
+		tree.ImmutableTree.root = NewNode(key, value, tree.WorkingVersion())
 		return nil, false
 	}
 	tree.ImmutableTree.root, updated, orphaned = tree.recursiveSet(tree.ImmutableTree.root, key, value)
@@ -87,34 +111,34 @@ func (tree *MutableTree) set(key []byte, value []byte) (orphaned []*Node, update
 func (tree *MutableTree) recursiveSet(node *Node, key []byte, value []byte) (
 	newSelf *Node, updated bool, orphaned []*Node,
 ) {
-	version := tree.version + 1
+	version := tree.WorkingVersion()
 
 	if node.isLeaf() {
 		switch bytes.Compare(key, node.key) {
 		case -1:
-			return &Node{
+			return tree.newInnerNode(&Node{
 				key:       node.key,
 				height:    1,
 				size:      2,
 				leftNode:  NewNode(key, value, version),
 				rightNode: node,
 				version:   version,
-			}, false, []*Node{}
+			}), false, []*Node{}
 		case 1:
-			return &Node{
+			return tree.newInnerNode(&Node{
 				key:       key,
 				height:    1,
 				size:      2,
 				leftNode:  node,
 				rightNode: NewNode(key, value, version),
 				version:   version,
-			}, false, []*Node{}
+			}), false, []*Node{}
 		default:
 			return NewNode(key, value, version), true, []*Node{node}
 		}
 	} else {
 		orphaned = append(orphaned, node)
-		node = node.clone(version)
+		node = tree.cloneNode(node)
 
 		if bytes.Compare(key, node.key) < 0 {
 			var leftOrphaned []*Node
@@ -141,6 +165,9 @@ func (tree *MutableTree) recursiveSet(node *Node, key []byte, value []byte) (
 func (tree *MutableTree) Remove(key []byte) ([]byte, bool) {
 	val, orphaned, removed := tree.remove(key)
 	tree.addOrphans(orphaned)
+	if removed {
+		tree.recordChange(KVChange{Key: key, Delete: true})
+	}
 	return val, removed
 }
 
@@ -171,8 +198,6 @@ func (tree *MutableTree) remove(key []byte) (value []byte, orphans []*Node, remo
 // - the removed value
 // - the orphaned nodes.
 func (tree *MutableTree) recursiveRemove(node *Node, key []byte) ([]byte, *Node, []byte, []byte, []*Node) {
-	version := tree.version + 1
-
 	if node.isLeaf() {
 		if bytes.Equal(key, node.key) {
 			return nil, nil, nil, node.value, []*Node{node}
@@ -191,7 +216,7 @@ func (tree *MutableTree) recursiveRemove(node *Node, key []byte) ([]byte, *Node,
 		}
 		orphaned = append(orphaned, node)
 
-		newNode := node.clone(version)
+		newNode := tree.cloneNode(node)
 		newNode.leftHash, newNode.leftNode = newLeftHash, newLeftNode
 		newNode.calcHeightAndSize(tree.ImmutableTree)
 		newNode, balanceOrphaned := tree.balance(newNode)
@@ -208,7 +233,7 @@ func (tree *MutableTree) recursiveRemove(node *Node, key []byte) ([]byte, *Node,
 	}
 	orphaned = append(orphaned, node)
 
-	newNode := node.clone(version)
+	newNode := tree.cloneNode(node)
 	newNode.rightHash, newNode.rightNode = newRightHash, newRightNode
 	if newKey != nil {
 		newNode.key = newKey
@@ -224,14 +249,16 @@ func (tree *MutableTree) Load() (int64, error) {
 	return tree.LoadVersion(int64(0))
 }
 
-// LazyLoadVersion attempts to lazy load only the specified target version
-// without loading previous roots/versions. Lazy loading should be used in cases
-// where only reads are expected. Any writes to a lazy loaded tree may result in
-// unexpected behavior. If the targetVersion is non-positive, the latest version
-// will be loaded by default. If the latest version is non-positive, this method
-// performs a no-op. Otherwise, if the root does not exist, an error will be
-// returned.
+// LazyLoadVersion loads only the specified target version without loading
+// previous roots/versions. Since versions are looked up on disk when needed,
+// the loaded tree can be written to like one loaded with LoadVersion. If the
+// targetVersion is non-positive, the latest version will be loaded by default.
+// If the latest version is non-positive, this method performs a no-op.
+// Otherwise, if the root does not exist, an error will be returned.
 func (tree *MutableTree) LazyLoadVersion(targetVersion int64) (int64, error) {
+	if err := tree.ndb.Flush(); err != nil {
+		return 0, err
+	}
 	latestVersion := tree.ndb.getLatestVersion()
 	if latestVersion < targetVersion {
 		return latestVersion, fmt.Errorf("wanted to load target %d but only found up to %d", targetVersion, latestVersion)
@@ -252,15 +279,16 @@ func (tree *MutableTree) LazyLoadVersion(targetVersion int64) (int64, error) {
 		return latestVersion, ErrVersionDoesNotExist
 	}
 
-	tree.versions[targetVersion] = true
-
 	iTree := &ImmutableTree{
 		ndb:     tree.ndb,
 		version: targetVersion,
-		root:    tree.ndb.GetNode(rootHash),
+	}
+	if len(rootHash) != 0 {
+		iTree.root = tree.ndb.GetNode(rootHash)
 	}
 
 	tree.orphans = map[string]int64{}
+	tree.changes = nil
 	tree.ImmutableTree = iTree
 	tree.lastSaved = iTree.clone()
 
@@ -269,24 +297,16 @@ func (tree *MutableTree) LazyLoadVersion(targetVersion int64) (int64, error) {
 
 // Returns the version number of the latest version found
 func (tree *MutableTree) LoadVersion(targetVersion int64) (int64, error) {
-	roots, err := tree.ndb.getRoots()
-	if err != nil {
+	if err := tree.ndb.Flush(); err != nil {
 		return 0, err
 	}
-
-	if len(roots) == 0 {
+	latestVersion := tree.ndb.getLatestVersion()
+	if latestVersion == 0 {
 		return 0, nil
 	}
-
-	latestVersion := int64(0)
-
-	var latestRoot []byte
-	for version, r := range roots {
-		tree.versions[version] = true
-		if version > latestVersion && (targetVersion == 0 || version <= targetVersion) {
-			latestVersion = version
-			latestRoot = r
-		}
+	if targetVersion > 0 && targetVersion < latestVersion {
+		// Find the latest version no later than the target.
+		latestVersion = tree.ndb.getPreviousVersion(targetVersion + 1)
 	}
 
 	if !(targetVersion == 0 || latestVersion == targetVersion) {
@@ -299,11 +319,12 @@ func (tree *MutableTree) LoadVersion(targetVersion int64) (int64, error) {
 		version: latestVersion,
 	}
 
-	if len(latestRoot) != 0 {
+	if latestRoot := tree.ndb.getRoot(latestVersion); len(latestRoot) != 0 {
 		t.root = tree.ndb.GetNode(latestRoot)
 	}
 
 	tree.orphans = map[string]int64{}
+	tree.changes = nil
 	tree.ImmutableTree = t
 	tree.lastSaved = t.clone()
 
@@ -317,7 +338,9 @@ func (tree *MutableTree) LoadVersionForOverwriting(targetVersion int64) (int64,
 	if err != nil {
 		return latestVersion, err
 	}
-	tree.deleteVersionsFrom(targetVersion + 1)
+	if err := tree.deleteVersionsFrom(latestVersion + 1); err != nil {
+		return latestVersion, err
+	}
 	return targetVersion, nil
 }
 
@@ -348,13 +371,73 @@ func (tree *MutableTree) Rollback() {
 		tree.ImmutableTree = &ImmutableTree{ndb: tree.ndb, version: 0}
 	}
 	tree.orphans = map[string]int64{}
+	tree.changes = nil
+}
+
+// Fork returns an independent working tree which shares all nodes with the
+// current working tree. The fork can be modified and hashed without affecting
+// this tree, and is either discarded or applied back with Merge. A fork can't
+// save or delete versions.
+//
+// Forks may be used concurrently with each other, but not while the parent
+// tree is saving a version.
+func (tree *MutableTree) Fork() *MutableTree {
+	// Hash the working tree up front, so that forks never write to the nodes
+	// they share.
+	tree.ImmutableTree.hashWithCount()
+
+	orphans := make(map[string]int64, len(tree.orphans))
+	for hash, version := range tree.orphans {
+		orphans[hash] = version
+	}
+
+	return &MutableTree{
+		ImmutableTree: tree.ImmutableTree.clone(),
+		lastSaved:     tree.lastSaved.clone(),
+		orphans:       orphans,
+		ndb:           tree.ndb,
+		listeners:     append([]ChangeSetListener(nil), tree.listeners...),
+		changes:       append(ChangeSet(nil), tree.changes...),
+		forkedFrom:    tree,
+		forkBase:      tree.ImmutableTree.clone(),
+	}
+}
+
+// Merge replaces the working tree with the working tree of a fork created by
+// Fork. It fails if the working tree was modified after the fork was created.
+// A fork can only be merged once.
+func (tree *MutableTree) Merge(fork *MutableTree) error {
+	if fork.forkedFrom != tree {
+		return cmn.NewError("tree was not forked from this tree")
+	}
+	if fork.forkBase == nil {
+		return cmn.NewError("fork was already merged")
+	}
+	if tree.ImmutableTree.root != fork.forkBase.root || tree.version != fork.forkBase.version {
+		return cmn.NewError("working tree was modified after the fork was created")
+	}
+
+	tree.ImmutableTree = fork.ImmutableTree.clone()
+	tree.orphans = fork.orphans
+	tree.changes = fork.changes
+
+	fork.forkBase = nil
+	fork.orphans = map[string]int64{}
+	fork.changes = nil
+
+	return nil
+}
+
+// IsFork returns whether or not the tree was created by Fork.
+func (tree *MutableTree) IsFork() bool {
+	return tree.forkedFrom != nil
 }
 
 // GetVersioned gets the value at the specified key and version.
 func (tree *MutableTree) GetVersioned(key []byte, version int64) (
 	index int64, value []byte,
 ) {
-	if tree.versions[version] {
+	if tree.VersionExists(version) {
 		t, err := tree.GetImmutable(version)
 		if err != nil {
 			return -1, nil
@@ -367,9 +450,39 @@ func (tree *MutableTree) GetVersioned(key []byte, version int64) (
 // SaveVersion saves a new tree version to disk, based on the current state of
 // the tree. Returns the hash and new version number.
 func (tree *MutableTree) SaveVersion() ([]byte, int64, error) {
-	version := tree.version + 1
+	return tree.saveVersion(tree.WorkingVersion(), nil)
+}
 
-	if tree.versions[version] {
+// SaveVersionAt is like SaveVersion, but saves the working tree as the given
+// version instead of the next one. Versions may be skipped, but they must be
+// increasing: version must be at least WorkingVersion. The nodes created since
+// the last saved version are given the saved version, so the root hash
+// differs from WorkingHash when versions are skipped.
+func (tree *MutableTree) SaveVersionAt(version int64) ([]byte, int64, error) {
+	return tree.saveVersion(version, nil)
+}
+
+// WorkingVersion returns the version which SaveVersion will save the working
+// tree as. The nodes created by the working tree are given this version until
+// they are saved, when they take the version they are saved as.
+func (tree *MutableTree) WorkingVersion() int64 {
+	if tree.version == 0 && tree.ndb.opts.InitialVersion > 0 {
+		return tree.ndb.opts.InitialVersion
+	}
+	return tree.version + 1
+}
+
+func (tree *MutableTree) saveVersion(version int64, meta *VersionMetadata) ([]byte, int64, error) {
+	if tree.IsFork() {
+		return nil, version, cmn.NewError("cannot save a forked tree, merge it instead")
+	}
+	if version < tree.WorkingVersion() {
+		return nil, version, cmn.NewError("cannot save version %d, expected at least %d",
+			version, tree.WorkingVersion())
+	}
+	tree.stampNodes(version)
+
+	if tree.VersionExists(version) {
 		//version already exists, throw an error if attempting to overwrite
 		// Same hash means idempotent.  Return success.
 		existingHash := tree.ndb.getRoot(version)
@@ -379,89 +492,163 @@ func (tree *MutableTree) SaveVersion() ([]byte, int64, error) {
 			tree.ImmutableTree = tree.ImmutableTree.clone()
 			tree.lastSaved = tree.ImmutableTree.clone()
 			tree.orphans = map[string]int64{}
+			if err := tree.notifyListeners(version, existingHash); err != nil {
+				return nil, version, err
+			}
 			return existingHash, version, nil
 		}
 		return nil, version, fmt.Errorf("version %d was already saved to different hash %X (existing hash %X)",
 			version, newHash, existingHash)
 	}
 
-	if tree.root == nil {
+	if tree.ndb.opts.AsyncCommit {
+		debug("SAVE TREE ASYNC %v\n", version)
+		// The orphans map is handed over to the background writer, and
+		// replaced below.
+		if err := tree.ndb.SaveVersionAsync(tree.root, version, tree.orphans, meta); err != nil {
+			return nil, version, err
+		}
+	} else if latest := tree.ndb.getLatestVersion(); version <= latest {
+		return nil, version, cmn.NewError("cannot save version %d, must be after the latest version %d",
+			version, latest)
+	} else if tree.root == nil {
 		// There can still be orphans, for example if the root is the node being
 		// removed.
 		debug("SAVE EMPTY TREE %v\n", version)
 		tree.ndb.SaveOrphans(version, tree.orphans)
 		tree.ndb.SaveEmptyRoot(version)
+		tree.ndb.SaveVersionMetadata(version, meta)
+		tree.ndb.Commit()
 	} else {
 		debug("SAVE TREE %v\n", version)
 		// Save the current tree.
 		tree.ndb.SaveBranch(tree.root)
 		tree.ndb.SaveOrphans(version, tree.orphans)
 		tree.ndb.SaveRoot(tree.root, version)
+		tree.ndb.SaveVersionMetadata(version, meta)
+		tree.ndb.Commit()
 	}
-	tree.ndb.Commit()
 	tree.version = version
-	tree.versions[version] = true
 
 	// Set new working tree.
 	tree.ImmutableTree = tree.ImmutableTree.clone()
 	tree.lastSaved = tree.ImmutableTree.clone()
 	tree.orphans = map[string]int64{}
+	if err := tree.notifyListeners(version, tree.Hash()); err != nil {
+		return nil, version, err
+	}
 
 	return tree.Hash(), version, nil
 }
 
+// stampNodes gives the nodes created by the working tree the version they are
+// about to be saved as. The nodes are copied rather than modified, since forks
+// may share them.
+func (tree *MutableTree) stampNodes(version int64) {
+	root := tree.ImmutableTree.root
+	if root == nil || root.persisted || root.version == version {
+		return
+	}
+	tree.ImmutableTree.root = stampNode(root, version)
+}
+
+// stampNode returns a copy of the unsaved nodes under node with the given
+// version. The unsaved nodes of a working tree are always above the saved
+// ones.
+func stampNode(node *Node, version int64) *Node {
+	if node == nil || node.persisted {
+		return node
+	}
+	stamped := *node
+	stamped.version = version
+	stamped.hash = nil
+	stamped.leftNode = stampNode(node.leftNode, version)
+	stamped.rightNode = stampNode(node.rightNode, version)
+	return &stamped
+}
+
 // DeleteVersion deletes a tree version from disk. The version can then no
 // longer be accessed.
 func (tree *MutableTree) DeleteVersion(version int64) error {
+	if tree.IsFork() {
+		return cmn.NewError("cannot delete a version from a forked tree")
+	}
 	if version == 0 {
 		return cmn.NewError("version must be greater than 0")
 	}
 	if version == tree.version {
 		return cmn.NewError("cannot delete latest saved version (%d)", version)
 	}
-	if _, ok := tree.versions[version]; !ok {
+	if !tree.VersionExists(version) {
 		return cmn.ErrorWrap(ErrVersionDoesNotExist, "")
 	}
+	if err := tree.checkNotPinned(version); err != nil {
+		return err
+	}
 
-	tree.ndb.DeleteVersion(version, true)
-	tree.ndb.Commit()
-
-	delete(tree.versions, version)
+	if tree.ndb.opts.AsyncCommit {
+		if err := tree.ndb.DeleteVersionAsync(version); err != nil {
+			return err
+		}
+	} else {
+		tree.ndb.DeleteVersion(version, true)
+		tree.ndb.Commit()
+	}
 
 	return nil
 }
 
+// Flush waits for the versions saved and deleted in the background to be
+// written to disk, and returns the first error encountered while writing them.
+// It is a no-op unless Options.AsyncCommit is set.
+func (tree *MutableTree) Flush() error {
+	return tree.ndb.Flush()
+}
+
+// Close waits for pending background writes and stops the background writer.
+// It does not close the underlying database.
+func (tree *MutableTree) Close() error {
+	return tree.ndb.Close()
+}
+
 // deleteVersionsFrom deletes tree version from disk specified version to latest version. The version can then no
 // longer be accessed.
 func (tree *MutableTree) deleteVersionsFrom(version int64) error {
 	if version <= 0 {
 		return cmn.NewError("version must be greater than 0")
 	}
-	newLatestVersion := version - 1
-	lastestVersion := tree.ndb.getLatestVersion()
-	for ; version <= lastestVersion; version++ {
-		if version == tree.version {
-			return cmn.NewError("cannot delete latest saved version (%d)", version)
+	if err := tree.ndb.Flush(); err != nil {
+		return err
+	}
+
+	// Versions may not be consecutive, so only the existing ones are deleted.
+	toDelete := []int64{}
+	for _, v := range tree.ndb.getVersions() {
+		if v < version {
+			continue
 		}
-		if _, ok := tree.versions[version]; !ok {
-			return cmn.ErrorWrap(ErrVersionDoesNotExist, "")
+		if v == tree.version {
+			return cmn.NewError("cannot delete latest saved version (%d)", v)
 		}
-		tree.ndb.DeleteVersion(version, false)
-		delete(tree.versions, version)
+		if err := tree.checkNotPinned(v); err != nil {
+			return err
+		}
+		toDelete = append(toDelete, v)
+	}
+	for _, v := range toDelete {
+		tree.ndb.DeleteVersion(v, false)
 	}
 	tree.ndb.Commit()
-	tree.ndb.resetLatestVersion(newLatestVersion)
+	tree.ndb.resetLatestVersion(tree.ndb.getPreviousVersion(version))
 	return nil
 }
 
 // Rotate right and return the new node and orphan.
 func (tree *MutableTree) rotateRight(node *Node) (*Node, *Node) {
-	version := tree.version + 1
-
 	// TODO: optimize balance & rotate.
-	node = node.clone(version)
+	node = tree.cloneNode(node)
 	orphaned := node.getLeftNode(tree.ImmutableTree)
-	newNode := orphaned.clone(version)
+	newNode := tree.cloneNode(orphaned)
 
 	newNoderHash, newNoderCached := newNode.rightHash, newNode.rightNode
 	newNode.rightHash, newNode.rightNode = node.hash, node
@@ -475,12 +662,10 @@ func (tree *MutableTree) rotateRight(node *Node) (*Node, *Node) {
 
 // Rotate left and return the new node and orphan.
 func (tree *MutableTree) rotateLeft(node *Node) (*Node, *Node) {
-	version := tree.version + 1
-
 	// TODO: optimize balance & rotate.
-	node = node.clone(version)
+	node = tree.cloneNode(node)
 	orphaned := node.getRightNode(tree.ImmutableTree)
-	newNode := orphaned.clone(version)
+	newNode := tree.cloneNode(orphaned)
 
 	newNodelHash, newNodelCached := newNode.leftHash, newNode.leftNode
 	newNode.leftHash, newNode.leftNode = node.hash, node
@@ -536,6 +721,26 @@ func (tree *MutableTree) balance(node *Node) (newSelf *Node, orphaned []*Node) {
 	return node, []*Node{}
 }
 
+// cloneNode returns a copy of an inner node which can be modified in the
+// working version. Inside ApplyBatch, nodes created by the batch are returned
+// as is instead, so that the paths shared by the batch's keys are only cloned
+// once.
+func (tree *MutableTree) cloneNode(node *Node) *Node {
+	if _, ok := tree.batchNodes[node]; ok {
+		node.hash = nil
+		return node
+	}
+	return tree.newInnerNode(node.clone(tree.WorkingVersion()))
+}
+
+// newInnerNode tracks an inner node created for the working version.
+func (tree *MutableTree) newInnerNode(node *Node) *Node {
+	if tree.batchNodes != nil {
+		tree.batchNodes[node] = struct{}{}
+	}
+	return node
+}
+
 func (tree *MutableTree) addOrphans(orphans []*Node) {
 	for _, node := range orphans {
 		if !node.persisted {
@@ -192,6 +192,22 @@ func (node *Node) getByIndex(t *ImmutableTree, index int64) (key []byte, value [
 	return node.getRightNode(t).getByIndex(t, index-leftNode.size)
 }
 
+// Calls fn for the leaves under the node with an index between from and to,
+// relative to the node's leftmost leaf.
+func (node *Node) iterateByIndex(t *ImmutableTree, from, to int64, fn func(key []byte, value []byte) bool) bool {
+	if from >= node.size || to <= 0 || from >= to {
+		return false
+	}
+	if node.isLeaf() {
+		return fn(node.key, node.value)
+	}
+	leftNode := node.getLeftNode(t)
+	if leftNode.iterateByIndex(t, from, to, fn) {
+		return true
+	}
+	return node.getRightNode(t).iterateByIndex(t, from-leftNode.size, to-leftNode.size, fn)
+}
+
 // Computes the hash of the node without computing its descendants. Must be
 // called on nodes which have descendant node hashes already computed.
 func (node *Node) _hash() []byte {
@@ -229,6 +245,49 @@ func (node *Node) hashWithCount() ([]byte, int64) {
 	return node.hash, hashCount + 1
 }
 
+// Minimum height of a node whose subtrees are hashed concurrently by
+// hashParallel. Smaller subtrees aren't worth the goroutine.
+const parallelHashHeight = 6
+
+// hashParallel hashes the node and its descendants like hashWithCount, but
+// hashes the left and right subtrees of a node concurrently while there are
+// fewer than workers goroutines hashing.
+func (node *Node) hashParallel(workers int) []byte {
+	if workers <= 1 {
+		hash, _ := node.hashWithCount()
+		return hash
+	}
+	return node.hashWithPool(make(chan struct{}, workers-1))
+}
+
+// hashWithPool hashes the node, running the left subtree on another
+// goroutine if one of the slots in pool is free.
+func (node *Node) hashWithPool(pool chan struct{}) []byte {
+	if node.hash != nil {
+		return node.hash
+	}
+	if node.height < parallelHashHeight || node.leftNode == nil || node.rightNode == nil {
+		hash, _ := node.hashWithCount()
+		return hash
+	}
+
+	select {
+	case pool <- struct{}{}:
+		done := make(chan struct{})
+		go func() {
+			node.leftHash = node.leftNode.hashWithPool(pool)
+			<-pool
+			close(done)
+		}()
+		node.rightHash = node.rightNode.hashWithPool(pool)
+		<-done
+	default:
+		node.leftHash = node.leftNode.hashWithPool(pool)
+		node.rightHash = node.rightNode.hashWithPool(pool)
+	}
+	return node._hash()
+}
+
 // Writes the node's hash to the given io.Writer. This function expects
 // child hashes to be already set.
 func (node *Node) writeHashBytes(w io.Writer) cmn.Error {
@@ -342,17 +401,25 @@ func (node *Node) writeBytes(w io.Writer) cmn.Error {
 }
 
 func (node *Node) getLeftNode(t *ImmutableTree) *Node {
-	if node.leftNode != nil {
-		return node.leftNode
+	leftNode := node.leftNode
+	if leftNode == nil {
+		leftNode = t.ndb.GetNode(node.leftHash)
+	}
+	if t != nil {
+		t.getTrace().record(leftNode)
 	}
-	return t.ndb.GetNode(node.leftHash)
+	return leftNode
 }
 
 func (node *Node) getRightNode(t *ImmutableTree) *Node {
-	if node.rightNode != nil {
-		return node.rightNode
+	rightNode := node.rightNode
+	if rightNode == nil {
+		rightNode = t.ndb.GetNode(node.rightHash)
 	}
-	return t.ndb.GetNode(node.rightHash)
+	if t != nil {
+		t.getTrace().record(rightNode)
+	}
+	return rightNode
 }
 
 // NOTE: mutates height and size
@@ -430,3 +497,10 @@ func (node *Node) lmd(t *ImmutableTree) *Node {
 	}
 	return node.getLeftNode(t).lmd(t)
 }
+
+func (node *Node) rmd(t *ImmutableTree) *Node {
+	if node.isLeaf() {
+		return node
+	}
+	return node.getRightNode(t).rmd(t)
+}
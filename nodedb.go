@@ -4,16 +4,22 @@ import (
 	"bytes"
 	"container/list"
 	"fmt"
+	"runtime"
 	"sort"
 	"sync"
+	"time"
 
 	"github.com/tendermint/tendermint/crypto/tmhash"
+	cmn "github.com/tendermint/tendermint/libs/common"
 	dbm "github.com/tendermint/tendermint/libs/db"
 )
 
 const (
 	int64Size = 8
 	hashSize  = tmhash.Size
+
+	// Number of root hashes kept in memory by nodeDB.getRoot.
+	rootCacheSize = 10000
 )
 
 var (
@@ -30,27 +36,64 @@ var (
 
 	// Root nodes are indexed separately by their version
 	rootKeyFormat = NewKeyFormat('r', int64Size) // r<version>
+
+	// Version metadata is indexed by version, and by time for the versions
+	// which have one.
+	metadataKeyFormat     = NewKeyFormat('m', int64Size)            // m<version>
+	metadataTimeKeyFormat = NewKeyFormat('t', int64Size, int64Size) // t<unix-nanos><version>
+
+	// Checkpoints are keyed by their variable length name, following the
+	// prefix byte, and map to the pinned version.
+	checkpointKeyFormat = NewKeyFormat('c') // c<name>
 )
 
 type nodeDB struct {
 	mtx   sync.Mutex // Read/write lock.
 	db    dbm.DB     // Persistent node storage.
 	batch dbm.Batch  // Batched writing buffer.
+	opts  *Options   // Options to customize for pruning/writing
 
 	latestVersion  int64
 	nodeCache      map[string]*list.Element // Node cache.
 	nodeCacheSize  int                      // Node cache size limit in elements.
 	nodeCacheQueue *list.List               // LRU queue of cache elements. Used for deletion.
+
+	rootCache      map[int64]*list.Element // Root hash cache, by version.
+	rootCacheQueue *list.List              // LRU queue of root cache elements.
+
+	pendingNodes map[string]*Node           // Nodes staged by SaveVersionAsync, not yet on disk.
+	pendingRoots map[int64][]byte           // Roots staged by SaveVersionAsync, or nil if deleted by DeleteVersionAsync.
+	pendingMeta  map[int64]*VersionMetadata // Metadata staged by SaveVersionAsync.
+
+	checkpoints map[string]int64 // Pinned versions by checkpoint name, nil until loaded.
+
+	partial bool // Set for trees loaded from a witness, whose missing nodes aren't available.
+
+	jobsMtx sync.Mutex        // Guards jobs and jobsErr.
+	jobs    chan func() error // Background write queue, nil if the writer isn't running.
+	jobsWg  sync.WaitGroup    // Number of queued and running jobs.
+	jobsErr error             // First error returned by a background job.
 }
 
-func newNodeDB(db dbm.DB, cacheSize int) *nodeDB {
+func newNodeDB(db dbm.DB, cacheSize int, opts *Options) *nodeDB {
+	if opts.SaveWorkers <= 0 {
+		withWorkers := *opts
+		withWorkers.SaveWorkers = runtime.NumCPU()
+		opts = &withWorkers
+	}
 	ndb := &nodeDB{
 		db:             db,
 		batch:          db.NewBatch(),
+		opts:           opts,
 		latestVersion:  0, // initially invalid
 		nodeCache:      make(map[string]*list.Element),
 		nodeCacheSize:  cacheSize,
 		nodeCacheQueue: list.New(),
+		rootCache:      make(map[int64]*list.Element),
+		rootCacheQueue: list.New(),
+		pendingNodes:   make(map[string]*Node),
+		pendingRoots:   make(map[int64][]byte),
+		pendingMeta:    make(map[int64]*VersionMetadata),
 	}
 	return ndb
 }
@@ -72,9 +115,17 @@ func (ndb *nodeDB) GetNode(hash []byte) *Node {
 		return elem.Value.(*Node)
 	}
 
+	// Check nodes which are still being written in the background.
+	if node, ok := ndb.pendingNodes[string(hash)]; ok {
+		return node
+	}
+
 	// Doesn't exist, load.
 	buf := ndb.db.Get(ndb.nodeKey(hash))
 	if buf == nil {
+		if ndb.partial {
+			panic(cmn.ErrorWrap(ErrNotAvailable, "node %X", hash))
+		}
 		panic(fmt.Sprintf("Value missing for hash %x corresponding to nodeKey %s", hash, ndb.nodeKey(hash)))
 	}
 
@@ -102,20 +153,31 @@ func (ndb *nodeDB) SaveNode(node *Node) {
 		panic("Shouldn't be calling save on an already persisted node.")
 	}
 
-	// Save node bytes to db.
+	ndb.writeNode(node)
+
+	node.persisted = true
+	ndb.cacheNode(node)
+}
+
+// Writes the node bytes to the batch.
+func (ndb *nodeDB) writeNode(node *Node) {
 	buf := new(bytes.Buffer)
 	if err := node.writeBytes(buf); err != nil {
 		panic(err)
 	}
 	ndb.batch.Set(ndb.nodeKey(node.hash), buf.Bytes())
 	debug("BATCH SAVE %X %p\n", node.hash, node)
-
-	node.persisted = true
-	ndb.cacheNode(node)
 }
 
 // Has checks if a hash exists in the database.
 func (ndb *nodeDB) Has(hash []byte) bool {
+	ndb.mtx.Lock()
+	_, pending := ndb.pendingNodes[string(hash)]
+	ndb.mtx.Unlock()
+	if pending {
+		return true
+	}
+
 	key := ndb.nodeKey(hash)
 
 	if ldb, ok := ndb.db.(*dbm.GoLevelDB); ok {
@@ -131,26 +193,71 @@ func (ndb *nodeDB) Has(hash []byte) bool {
 // SaveBranch saves the given node and all of its descendants.
 // NOTE: This function clears leftNode/rigthNode recursively and
 // calls _hash() on the given node.
-// TODO refactor, maybe use hashWithCount() but provide a callback.
 func (ndb *nodeDB) SaveBranch(node *Node) []byte {
 	if node.persisted {
 		return node.hash
 	}
 
-	if node.leftNode != nil {
-		node.leftHash = ndb.SaveBranch(node.leftNode)
-	}
-	if node.rightNode != nil {
-		node.rightHash = ndb.SaveBranch(node.rightNode)
-	}
+	node.hashParallel(ndb.opts.SaveWorkers)
+	ndb.writeNodes(ndb.stageBranch(node, nil))
 
-	node._hash()
-	ndb.SaveNode(node)
+	return node.hash
+}
 
-	node.leftNode = nil
-	node.rightNode = nil
+// Minimum number of nodes encoded by each goroutine in writeNodes.
+const minWriteChunk = 128
 
-	return node.hash
+// writeNodes writes the hashed nodes to the batch, in order.
+func (ndb *nodeDB) writeNodes(nodes []*Node) {
+	encoded := ndb.encodeNodes(nodes)
+
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	for i, node := range nodes {
+		ndb.batch.Set(ndb.nodeKey(node.hash), encoded[i])
+		debug("BATCH SAVE %X %p\n", node.hash, node)
+	}
+}
+
+// encodeNodes encodes the hashed nodes concurrently, on up to
+// Options.SaveWorkers goroutines.
+func (ndb *nodeDB) encodeNodes(nodes []*Node) [][]byte {
+	encoded := make([][]byte, len(nodes))
+	encode := func(from, to int) {
+		for i := from; i < to; i++ {
+			buf := new(bytes.Buffer)
+			if err := nodes[i].writeBytes(buf); err != nil {
+				panic(err)
+			}
+			encoded[i] = buf.Bytes()
+		}
+	}
+
+	chunk := len(nodes)
+	if workers := ndb.opts.SaveWorkers; workers > 1 {
+		chunk = (len(nodes) + workers - 1) / workers
+		if chunk < minWriteChunk {
+			chunk = minWriteChunk
+		}
+	}
+	if chunk >= len(nodes) {
+		encode(0, len(nodes))
+	} else {
+		var wg sync.WaitGroup
+		for from := 0; from < len(nodes); from += chunk {
+			to := from + chunk
+			if to > len(nodes) {
+				to = len(nodes)
+			}
+			wg.Add(1)
+			go func(from, to int) {
+				defer wg.Done()
+				encode(from, to)
+			}(from, to)
+		}
+		wg.Wait()
+	}
+	return encoded
 }
 
 // DeleteVersion deletes a tree version from disk.
@@ -160,6 +267,7 @@ func (ndb *nodeDB) DeleteVersion(version int64, checkLatestVersion bool) {
 
 	ndb.deleteOrphans(version)
 	ndb.deleteRoot(version, checkLatestVersion)
+	ndb.deleteVersionMetadata(version)
 }
 
 // Saves orphaned nodes to disk under a special prefix.
@@ -172,17 +280,17 @@ func (ndb *nodeDB) SaveOrphans(version int64, orphans map[string]int64) {
 	toVersion := ndb.getPreviousVersion(version)
 	for hash, fromVersion := range orphans {
 		debug("SAVEORPHAN %v-%v %X\n", fromVersion, toVersion, hash)
-		ndb.saveOrphan([]byte(hash), fromVersion, toVersion)
+		ndb.saveOrphan(ndb.batch, []byte(hash), fromVersion, toVersion)
 	}
 }
 
 // Saves a single orphan to disk.
-func (ndb *nodeDB) saveOrphan(hash []byte, fromVersion, toVersion int64) {
+func (ndb *nodeDB) saveOrphan(batch dbm.Batch, hash []byte, fromVersion, toVersion int64) {
 	if fromVersion > toVersion {
 		panic(fmt.Sprintf("Orphan expires before it comes alive.  %d > %d", fromVersion, toVersion))
 	}
 	key := ndb.orphanKey(fromVersion, toVersion, hash)
-	ndb.batch.Set(key, hash)
+	batch.Set(key, hash)
 }
 
 // deleteOrphans deletes orphaned nodes from disk, and the associated orphan
@@ -214,7 +322,7 @@ func (ndb *nodeDB) deleteOrphans(version int64) {
 			ndb.uncacheNode(hash)
 		} else {
 			debug("MOVE predecessor:%v fromVersion:%v toVersion:%v %X\n", predecessor, fromVersion, toVersion, hash)
-			ndb.saveOrphan(hash, fromVersion, predecessor)
+			ndb.saveOrphan(ndb.batch, hash, fromVersion, predecessor)
 		}
 	})
 }
@@ -273,6 +381,7 @@ func (ndb *nodeDB) deleteRoot(version int64, checkLatestVersion bool) {
 
 	key := ndb.rootKey(version)
 	ndb.batch.Delete(key)
+	ndb.uncacheRoot(version)
 }
 
 func (ndb *nodeDB) traverseOrphans(fn func(k, v []byte)) {
@@ -334,8 +443,74 @@ func (ndb *nodeDB) Commit() {
 	ndb.batch = ndb.db.NewBatch()
 }
 
+// getRoot returns the root hash of a version, an empty slice if the version
+// is empty or nil if it doesn't exist.
 func (ndb *nodeDB) getRoot(version int64) []byte {
-	return ndb.db.Get(ndb.rootKey(version))
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+
+	if hash, ok := ndb.pendingRoots[version]; ok {
+		return hash
+	}
+	if elem, ok := ndb.rootCache[version]; ok {
+		ndb.rootCacheQueue.MoveToBack(elem)
+		return elem.Value.(versionRoot).hash
+	}
+
+	hash := ndb.db.Get(ndb.rootKey(version))
+	if hash != nil {
+		ndb.cacheRoot(version, hash)
+	}
+	return hash
+}
+
+// getVersions returns all saved versions in ascending order, including those
+// staged for a background write.
+func (ndb *nodeDB) getVersions() []int64 {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+
+	versions := []int64{}
+	ndb.traversePrefix(rootKeyFormat.Key(), func(k, v []byte) {
+		var version int64
+		rootKeyFormat.Scan(k, &version)
+		if hash, ok := ndb.pendingRoots[version]; !ok || hash != nil {
+			versions = append(versions, version)
+		}
+	})
+	for version, hash := range ndb.pendingRoots {
+		if hash != nil && ndb.db.Get(ndb.rootKey(version)) == nil {
+			versions = append(versions, version)
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i] < versions[j]
+	})
+	return versions
+}
+
+type versionRoot struct {
+	version int64
+	hash    []byte
+}
+
+// Add a root hash to the cache and pop the least recently used one if we've
+// reached the cache size limit.
+func (ndb *nodeDB) cacheRoot(version int64, hash []byte) {
+	elem := ndb.rootCacheQueue.PushBack(versionRoot{version, hash})
+	ndb.rootCache[version] = elem
+
+	if ndb.rootCacheQueue.Len() > rootCacheSize {
+		oldest := ndb.rootCacheQueue.Front()
+		delete(ndb.rootCache, ndb.rootCacheQueue.Remove(oldest).(versionRoot).version)
+	}
+}
+
+func (ndb *nodeDB) uncacheRoot(version int64) {
+	if elem, ok := ndb.rootCache[version]; ok {
+		ndb.rootCacheQueue.Remove(elem)
+		delete(ndb.rootCache, version)
+	}
 }
 
 func (ndb *nodeDB) getRoots() (map[int64][]byte, error) {
@@ -367,8 +542,8 @@ func (ndb *nodeDB) saveRoot(hash []byte, version int64) error {
 	ndb.mtx.Lock()
 	defer ndb.mtx.Unlock()
 
-	if version != ndb.getLatestVersion()+1 {
-		return fmt.Errorf("Must save consecutive versions. Expected %d, got %d", ndb.getLatestVersion()+1, version)
+	if version <= ndb.getLatestVersion() {
+		return fmt.Errorf("Must save increasing versions. Expected more than %d, got %d", ndb.getLatestVersion(), version)
 	}
 
 	key := ndb.rootKey(version)
@@ -378,6 +553,418 @@ func (ndb *nodeDB) saveRoot(hash []byte, version int64) error {
 	return nil
 }
 
+// SaveVersionMetadata writes the metadata of a version to the batch. A nil
+// meta is ignored.
+func (ndb *nodeDB) SaveVersionMetadata(version int64, meta *VersionMetadata) {
+	if meta == nil {
+		return
+	}
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+
+	ndb.writeVersionMetadata(ndb.batch, version, meta)
+}
+
+func (ndb *nodeDB) writeVersionMetadata(batch dbm.Batch, version int64, meta *VersionMetadata) {
+	batch.Set(metadataKeyFormat.Key(version), meta.bytes())
+	if meta.timeIndexed() {
+		batch.Set(metadataTimeKeyFormat.Key(meta.Time.UnixNano(), version), []byte{})
+	}
+}
+
+// deleteVersionMetadata deletes the metadata of a version, if any.
+func (ndb *nodeDB) deleteVersionMetadata(version int64) {
+	meta, err := ndb.readVersionMetadata(version)
+	if err != nil {
+		panic(err)
+	}
+	if meta == nil {
+		return
+	}
+	ndb.batch.Delete(metadataKeyFormat.Key(version))
+	if meta.timeIndexed() {
+		ndb.batch.Delete(metadataTimeKeyFormat.Key(meta.Time.UnixNano(), version))
+	}
+}
+
+func (ndb *nodeDB) getVersionMetadata(version int64) (*VersionMetadata, error) {
+	ndb.mtx.Lock()
+	meta, pending := ndb.pendingMeta[version]
+	ndb.mtx.Unlock()
+	if pending {
+		return meta, nil
+	}
+	return ndb.readVersionMetadata(version)
+}
+
+func (ndb *nodeDB) readVersionMetadata(version int64) (*VersionMetadata, error) {
+	buf := ndb.db.Get(metadataKeyFormat.Key(version))
+	if buf == nil {
+		return nil, nil
+	}
+	meta, err := makeVersionMetadata(buf)
+	if err != nil {
+		return nil, cmn.ErrorWrap(err, "reading metadata of version %d", version)
+	}
+	return meta, nil
+}
+
+// getVersionAtTime returns the latest version with a metadata time at or
+// before t, or 0 if there is none.
+func (ndb *nodeDB) getVersionAtTime(t time.Time) int64 {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+
+	nanos := t.UnixNano()
+	latestNanos, latestVersion := int64(0), int64(0)
+	for version, meta := range ndb.pendingMeta {
+		if !meta.timeIndexed() || meta.Time.UnixNano() > nanos {
+			continue
+		}
+		if meta.Time.UnixNano() > latestNanos ||
+			meta.Time.UnixNano() == latestNanos && version > latestVersion {
+			latestNanos, latestVersion = meta.Time.UnixNano(), version
+		}
+	}
+
+	itr := ndb.db.ReverseIterator(
+		metadataTimeKeyFormat.Key(),
+		metadataTimeKeyFormat.Key(nanos+1),
+	)
+	defer itr.Close()
+
+	for ; itr.Valid(); itr.Next() {
+		var timeNanos, version int64
+		metadataTimeKeyFormat.Scan(itr.Key(), &timeNanos, &version)
+		if hash, deleted := ndb.pendingRoots[version]; deleted && hash == nil {
+			continue
+		}
+		if timeNanos > latestNanos || timeNanos == latestNanos && version > latestVersion {
+			latestVersion = version
+		}
+		break
+	}
+	return latestVersion
+}
+
+// saveCheckpoint pins a version under a name. The checkpoint takes effect
+// right away, and is written to disk after the pending background writes, so
+// that it never pins a version which isn't on disk.
+func (ndb *nodeDB) saveCheckpoint(name string, version int64) error {
+	key := ndb.checkpointKey(name)
+	err := ndb.commitWrite(func(batch dbm.Batch) {
+		batch.Set(key, formatUint64(uint64(version)))
+	})
+	if err != nil {
+		return err
+	}
+
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	ndb.loadCheckpoints()
+	ndb.checkpoints[name] = version
+	return nil
+}
+
+func (ndb *nodeDB) deleteCheckpoint(name string) error {
+	key := ndb.checkpointKey(name)
+	err := ndb.commitWrite(func(batch dbm.Batch) {
+		batch.Delete(key)
+	})
+	if err != nil {
+		return err
+	}
+
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	ndb.loadCheckpoints()
+	delete(ndb.checkpoints, name)
+	return nil
+}
+
+func (ndb *nodeDB) getCheckpoints() map[string]int64 {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	ndb.loadCheckpoints()
+
+	checkpoints := make(map[string]int64, len(ndb.checkpoints))
+	for name, version := range ndb.checkpoints {
+		checkpoints[name] = version
+	}
+	return checkpoints
+}
+
+// loadCheckpoints reads the checkpoints from disk the first time they are
+// needed, they are then kept in memory.
+func (ndb *nodeDB) loadCheckpoints() {
+	if ndb.checkpoints != nil {
+		return
+	}
+	ndb.checkpoints = map[string]int64{}
+	ndb.traversePrefix(checkpointKeyFormat.Key(), func(k, v []byte) {
+		var version int64
+		scan(&version, v)
+		ndb.checkpoints[string(k[1:])] = version
+	})
+}
+
+func (ndb *nodeDB) checkpointKey(name string) []byte {
+	return append(checkpointKeyFormat.Key(), name...)
+}
+
+////////////////// Background writes ///////////////////////////////////////////
+
+// SaveVersionAsync hashes the branch under root and stages it, together with
+// the root entry, so that it can be read right away. The nodes, orphans and
+// root are then written to disk in the background, in a batch of their own.
+// The staged nodes are
+// marked as persisted, and their child pointers are cleared as in SaveBranch.
+// A nil root saves an empty tree. The version must be after the latest one,
+// including those still being written.
+func (ndb *nodeDB) SaveVersionAsync(root *Node, version int64, orphans map[string]int64, meta *VersionMetadata) error {
+	if err := ndb.asyncErr(); err != nil {
+		return err
+	}
+	ndb.mtx.Lock()
+	latest := ndb.getLatestVersion()
+	for pending, hash := range ndb.pendingRoots {
+		if hash != nil && pending > latest {
+			latest = pending
+		}
+	}
+	ndb.mtx.Unlock()
+	if version <= latest {
+		return fmt.Errorf("Must save increasing versions. Expected more than %d, got %d", latest, version)
+	}
+
+	nodes := []*Node{}
+	rootHash := []byte{}
+	if root != nil {
+		root.hashParallel(ndb.opts.SaveWorkers)
+		nodes = ndb.stageBranch(root, nodes)
+		rootHash = root.hash
+	}
+
+	ndb.mtx.Lock()
+	for _, node := range nodes {
+		ndb.pendingNodes[string(node.hash)] = node
+	}
+	ndb.pendingRoots[version] = rootHash
+	if meta != nil {
+		ndb.pendingMeta[version] = meta
+	}
+	ndb.mtx.Unlock()
+
+	ndb.enqueue(func() error {
+		err := ndb.writeVersion(version, rootHash, nodes, orphans, meta)
+		ndb.unstageVersion(version, nodes, err != nil)
+		return err
+	})
+	return nil
+}
+
+// writeVersion writes a version staged by SaveVersionAsync to disk. Its writes
+// go through a batch of their own, which is dropped if any of them fails.
+func (ndb *nodeDB) writeVersion(version int64, rootHash []byte, nodes []*Node, orphans map[string]int64, meta *VersionMetadata) (err error) {
+	batch := ndb.db.NewBatch()
+	defer batch.Close()
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("writing version %d: %v", version, r)
+		}
+	}()
+
+	encoded := ndb.encodeNodes(nodes)
+
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+
+	if version <= ndb.getLatestVersion() {
+		return fmt.Errorf("Must save increasing versions. Expected more than %d, got %d", ndb.getLatestVersion(), version)
+	}
+	for i, node := range nodes {
+		batch.Set(ndb.nodeKey(node.hash), encoded[i])
+	}
+	toVersion := ndb.getPreviousVersion(version)
+	for hash, fromVersion := range orphans {
+		ndb.saveOrphan(batch, []byte(hash), fromVersion, toVersion)
+	}
+	batch.Set(ndb.rootKey(version), rootHash)
+	if meta != nil {
+		ndb.writeVersionMetadata(batch, version, meta)
+	}
+	batch.Write()
+	ndb.updateLatestVersion(version)
+	return nil
+}
+
+// unstageVersion drops the nodes, root and metadata of a version staged by
+// SaveVersionAsync once it is written. If discard is set, the version failed
+// to be written, and its nodes are also dropped from the cache.
+func (ndb *nodeDB) unstageVersion(version int64, nodes []*Node, discard bool) {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+
+	for _, node := range nodes {
+		delete(ndb.pendingNodes, string(node.hash))
+		if discard {
+			ndb.uncacheNode(node.hash)
+		}
+	}
+	// Keep the entry if the version was deleted in the meantime.
+	if ndb.pendingRoots[version] != nil {
+		delete(ndb.pendingRoots, version)
+	}
+	delete(ndb.pendingMeta, version)
+}
+
+// DeleteVersionAsync deletes a tree version from disk in the background.
+func (ndb *nodeDB) DeleteVersionAsync(version int64) error {
+	if err := ndb.asyncErr(); err != nil {
+		return err
+	}
+
+	// Hide the version right away.
+	ndb.mtx.Lock()
+	ndb.pendingRoots[version] = nil
+	delete(ndb.pendingMeta, version)
+	ndb.uncacheRoot(version)
+	ndb.mtx.Unlock()
+
+	ndb.enqueue(func() error {
+		ndb.DeleteVersion(version, true)
+		ndb.Commit()
+
+		ndb.mtx.Lock()
+		if ndb.pendingRoots[version] == nil {
+			delete(ndb.pendingRoots, version)
+		}
+		ndb.mtx.Unlock()
+		return nil
+	})
+	return nil
+}
+
+// stageBranch marks the unsaved nodes under node as persisted and clears
+// their child pointers. The nodes are appended to staged in post-order.
+// Expects the node hashes to be computed.
+func (ndb *nodeDB) stageBranch(node *Node, staged []*Node) []*Node {
+	if node.persisted {
+		return staged
+	}
+	if node.leftNode != nil {
+		staged = ndb.stageBranch(node.leftNode, staged)
+	}
+	if node.rightNode != nil {
+		staged = ndb.stageBranch(node.rightNode, staged)
+	}
+
+	node.persisted = true
+	node.leftNode = nil
+	node.rightNode = nil
+
+	ndb.mtx.Lock()
+	ndb.cacheNode(node)
+	ndb.mtx.Unlock()
+
+	return append(staged, node)
+}
+
+// enqueue runs job on the background writer, starting it if needed. Jobs run
+// one at a time, in the order they were queued. Once a job fails, the
+// following jobs are skipped.
+func (ndb *nodeDB) enqueue(job func() error) {
+	ndb.jobsMtx.Lock()
+	if ndb.jobs == nil {
+		ndb.jobs = make(chan func() error, 16)
+		go ndb.runJobs(ndb.jobs)
+	}
+	jobs := ndb.jobs
+	ndb.jobsWg.Add(1)
+	ndb.jobsMtx.Unlock()
+
+	jobs <- job
+}
+
+func (ndb *nodeDB) runJobs(jobs <-chan func() error) {
+	for job := range jobs {
+		if ndb.asyncErr() == nil {
+			if err := runJob(job); err != nil {
+				ndb.jobsMtx.Lock()
+				ndb.jobsErr = err
+				ndb.jobsMtx.Unlock()
+			}
+		}
+		ndb.jobsWg.Done()
+	}
+}
+
+// runJob runs a background job, returning any panic as an error.
+func runJob(job func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("background write failed: %v", r)
+		}
+	}()
+	return job()
+}
+
+// commitWrite makes writes to the batch and commits it. With
+// Options.AsyncCommit, this is done by the background writer once the writes
+// queued so far are done.
+func (ndb *nodeDB) commitWrite(write func(batch dbm.Batch)) error {
+	commit := func() error {
+		ndb.mtx.Lock()
+		write(ndb.batch)
+		ndb.mtx.Unlock()
+		ndb.Commit()
+		return nil
+	}
+	if ndb.opts.AsyncCommit {
+		return ndb.afterWrites(commit)
+	}
+	return commit()
+}
+
+// afterWrites runs fn on the background writer once the writes queued so far
+// are done. It fails if one of them already failed, and fn is skipped if one
+// of them fails later.
+func (ndb *nodeDB) afterWrites(fn func() error) error {
+	if err := ndb.asyncErr(); err != nil {
+		return err
+	}
+	ndb.enqueue(fn)
+	return nil
+}
+
+func (ndb *nodeDB) asyncErr() error {
+	ndb.jobsMtx.Lock()
+	defer ndb.jobsMtx.Unlock()
+	return ndb.jobsErr
+}
+
+// Flush waits for all background writes to complete, and returns the first
+// error encountered by any of them.
+func (ndb *nodeDB) Flush() error {
+	ndb.jobsWg.Wait()
+	return ndb.asyncErr()
+}
+
+// Close waits for all background writes to complete and stops the background
+// writer. It does not close the underlying database.
+func (ndb *nodeDB) Close() error {
+	err := ndb.Flush()
+
+	ndb.jobsMtx.Lock()
+	if ndb.jobs != nil {
+		close(ndb.jobs)
+		ndb.jobs = nil
+	}
+	ndb.jobsMtx.Unlock()
+
+	return err
+}
+
 ////////////////// Utility and test functions /////////////////////////////////
 
 func (ndb *nodeDB) leafNodes() []*Node {
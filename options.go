@@ -0,0 +1,27 @@
+package iavl
+
+import "runtime"
+
+// Options define tree options.
+type Options struct {
+	// AsyncCommit makes SaveVersion and DeleteVersion return as soon as the
+	// new root hash is known, writing to disk in the background. Pending
+	// writes can be awaited with MutableTree.Flush.
+	AsyncCommit bool
+
+	// InitialVersion is the version at which the first version of an empty
+	// tree is saved. Versions start from 1 if it is 0.
+	InitialVersion int64
+
+	// SaveWorkers is the number of goroutines used to hash and encode the
+	// nodes written by SaveVersion. Nodes are processed sequentially if it
+	// is 1, and one goroutine per CPU is used if it is 0 or less.
+	SaveWorkers int
+}
+
+// DefaultOptions returns the default options for IAVL.
+func DefaultOptions() *Options {
+	return &Options{
+		SaveWorkers: runtime.NumCPU(),
+	}
+}
@@ -0,0 +1,536 @@
+package iavl
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/tendermint/tendermint/crypto/tmhash"
+	cmn "github.com/tendermint/tendermint/libs/common"
+)
+
+// ErrNotAvailable is returned by a PartialTree, and by trees loaded from a
+// witness, for queries which need nodes or values they don't hold.
+var ErrNotAvailable = fmt.Errorf("not available in partial tree")
+
+// PartialTree is a read-only version of a tree which holds only the nodes
+// proven by range proofs or witnesses, checked against its root hash. It
+// answers queries within the proven region as an ImmutableTree would, and
+// fails with ErrNotAvailable outside of it. A witness can also be loaded as a
+// writable tree by NewMutableTreeFromWitness, which fails the same way.
+type PartialTree struct {
+	root  []byte
+	nodes map[string]*partialNode
+}
+
+// partialNode is a node of a PartialTree. The value of a leaf is unknown if
+// only its hash was proven, and so is the key of an inner node if the
+// leftmost leaf of its right subtree wasn't. Inner nodes are then navigated
+// by the keys held under their children.
+type partialNode struct {
+	height    int8
+	size      int64
+	version   int64
+	key       []byte // Nil for inner nodes whose key is unknown.
+	value     []byte
+	valueHash []byte
+	hasValue  bool
+	leftHash  []byte
+	rightHash []byte
+
+	// The smallest and largest keys held under the node, if bounded.
+	minKey, maxKey []byte
+	bounded        bool
+}
+
+// NewPartialTree returns a partial tree with the given root hash, which holds
+// no nodes until proofs or witnesses are added. An empty root hash is the
+// empty tree, which needs none.
+func NewPartialTree(root []byte) *PartialTree {
+	return &PartialTree{
+		root:  root,
+		nodes: make(map[string]*partialNode),
+	}
+}
+
+// Hash returns the root hash of the tree.
+func (pt *PartialTree) Hash() []byte {
+	return pt.root
+}
+
+// AddRangeProof adds the nodes of a range proof of the tree, such as those
+// from ImmutableTree.GetRangeWithProof, along with the values of the given
+// keys, which must be among the proof's leaves. The values of its other
+// leaves aren't available.
+func (pt *PartialTree) AddRangeProof(proof *RangeProof, keys, values [][]byte) error {
+	if proof == nil {
+		return cmn.ErrorWrap(ErrInvalidProof, "proof is nil")
+	}
+	if len(keys) != len(values) {
+		return cmn.ErrorWrap(ErrInvalidInputs, "got %d keys and %d values", len(keys), len(values))
+	}
+	if err := proof.Verify(pt.root); err != nil {
+		return err
+	}
+	given := make(map[string][]byte, len(keys))
+	for i, key := range keys {
+		if err := proof.VerifyItem(key, values[i]); err != nil {
+			return err
+		}
+		given[string(key)] = values[i]
+	}
+
+	for i, path := range proof.leafPaths() {
+		leaf := proof.Leaves[i]
+		hash := leaf.Hash()
+		node := pt.add(hash, &partialNode{
+			size:      1,
+			version:   leaf.Version,
+			key:       leaf.Key,
+			valueHash: leaf.ValueHash,
+		})
+		if value, ok := given[string(leaf.Key)]; ok {
+			node.value, node.hasValue = value, true
+		}
+		for j := len(path) - 1; j >= 0; j-- {
+			pin := path[j]
+			inner := &partialNode{
+				height:    pin.Height,
+				size:      pin.Size,
+				version:   pin.Version,
+				leftHash:  pin.Left,
+				rightHash: pin.Right,
+			}
+			if len(pin.Left) == 0 {
+				inner.leftHash = hash
+			} else {
+				inner.rightHash = hash
+			}
+			hash = pin.Hash(hash)
+			pt.add(hash, inner)
+		}
+	}
+	pt.refresh()
+	return nil
+}
+
+// AddWitness adds the nodes of a witness of the tree, such as one from
+// ImmutableTree.StopTracing. The keys of its inner nodes are ignored, and
+// derived from its leaves instead.
+func (pt *PartialTree) AddWitness(witness *Witness) error {
+	if witness == nil {
+		return cmn.ErrorWrap(ErrInvalidProof, "witness is nil")
+	}
+	nodes := make([]*Node, 0, len(witness.Nodes))
+	for _, bz := range witness.Nodes {
+		node, err := MakeNode(bz)
+		if err != nil {
+			return cmn.ErrorWrap(err, "decoding witness node")
+		}
+		nodes = append(nodes, node)
+	}
+	for _, node := range nodes {
+		pn := &partialNode{
+			height:    node.height,
+			size:      node.size,
+			version:   node.version,
+			leftHash:  node.leftHash,
+			rightHash: node.rightHash,
+		}
+		if node.isLeaf() {
+			pn.key, pn.value, pn.hasValue = node.key, node.value, true
+			pn.valueHash = tmhash.Sum(node.value)
+		}
+		pt.add(node._hash(), pn)
+	}
+	pt.refresh()
+	return nil
+}
+
+// add adds the node under its hash, unless there already is one, and returns
+// the node held.
+func (pt *PartialTree) add(hash []byte, node *partialNode) *partialNode {
+	if existing, ok := pt.nodes[string(hash)]; ok {
+		if node.hasValue {
+			existing.value, existing.hasValue = node.value, true
+		}
+		return existing
+	}
+	pt.nodes[string(hash)] = node
+	return node
+}
+
+// refresh drops the nodes which can't be reached from the root, and derives
+// the keys of the inner nodes and the bounds of every node.
+func (pt *PartialTree) refresh() {
+	nodes := make(map[string]*partialNode, len(pt.nodes))
+	var walk func(hash []byte) *partialNode
+	walk = func(hash []byte) *partialNode {
+		node, ok := pt.nodes[string(hash)]
+		if !ok {
+			return nil
+		}
+		nodes[string(hash)] = node
+		if node.height == 0 {
+			node.minKey, node.maxKey, node.bounded = node.key, node.key, true
+			return node
+		}
+
+		left, right := walk(node.leftHash), walk(node.rightHash)
+		node.key = nil
+		for n := right; n != nil; n = nodes[string(n.leftHash)] {
+			if n.height == 0 {
+				node.key = n.key
+				break
+			}
+		}
+		node.bounded = false
+		if left != nil && left.bounded {
+			node.minKey, node.maxKey, node.bounded = left.minKey, left.maxKey, true
+		}
+		if right != nil && right.bounded {
+			if !node.bounded {
+				node.minKey = right.minKey
+			}
+			node.maxKey, node.bounded = right.maxKey, true
+		}
+		return node
+	}
+	walk(pt.root)
+	pt.nodes = nodes
+}
+
+// node returns the node with the given hash.
+func (pt *PartialTree) node(hash []byte) (*partialNode, error) {
+	node, ok := pt.nodes[string(hash)]
+	if !ok {
+		return nil, cmn.ErrorWrap(ErrNotAvailable, "node %X", hash)
+	}
+	return node, nil
+}
+
+// goLeft returns whether the key belongs under the left child of the inner
+// node. Without the node's key, it must be within the bounds of a child.
+func (pt *PartialTree) goLeft(node *partialNode, key []byte) (bool, error) {
+	if node.key != nil {
+		return bytes.Compare(key, node.key) < 0, nil
+	}
+	if left, ok := pt.nodes[string(node.leftHash)]; ok && left.bounded && bytes.Compare(key, left.maxKey) <= 0 {
+		return true, nil
+	}
+	if right, ok := pt.nodes[string(node.rightHash)]; ok && right.bounded && bytes.Compare(key, right.minKey) >= 0 {
+		return false, nil
+	}
+	return false, cmn.ErrorWrap(ErrNotAvailable, "key %X", key)
+}
+
+// get returns the index of the key and the leaf holding it, or the index it
+// would have and nil if it doesn't exist. The tree must not be empty.
+func (pt *PartialTree) get(key []byte) (index int64, leaf *partialNode, err error) {
+	node, err := pt.node(pt.root)
+	if err != nil {
+		return 0, nil, err
+	}
+	for node.height > 0 {
+		left, err := pt.goLeft(node, key)
+		if err != nil {
+			return 0, nil, err
+		}
+		if left {
+			node, err = pt.node(node.leftHash)
+		} else {
+			var right *partialNode
+			right, err = pt.node(node.rightHash)
+			if err == nil {
+				index += node.size - right.size
+				node = right
+			}
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+	switch bytes.Compare(key, node.key) {
+	case 1:
+		return index + 1, nil, nil
+	case 0:
+		return index, node, nil
+	}
+	return index, nil, nil
+}
+
+// size returns the number of leaves of the tree.
+func (pt *PartialTree) size() (int64, error) {
+	if len(pt.root) == 0 {
+		return 0, nil
+	}
+	root, err := pt.node(pt.root)
+	if err != nil {
+		return 0, err
+	}
+	return root.size, nil
+}
+
+// Get returns the index and value of the key, like ImmutableTree.Get.
+func (pt *PartialTree) Get(key []byte) (index int64, value []byte, err error) {
+	if len(pt.root) == 0 {
+		return 0, nil, nil
+	}
+	index, leaf, err := pt.get(key)
+	if err != nil || leaf == nil {
+		return index, nil, err
+	}
+	if !leaf.hasValue {
+		return 0, nil, cmn.ErrorWrap(ErrNotAvailable, "value of key %X", key)
+	}
+	return index, leaf.value, nil
+}
+
+// Has returns whether the key exists.
+func (pt *PartialTree) Has(key []byte) (bool, error) {
+	if len(pt.root) == 0 {
+		return false, nil
+	}
+	_, leaf, err := pt.get(key)
+	return leaf != nil, err
+}
+
+// Iterate calls fn with each key/value pair of the tree, in order, until fn
+// returns true. The whole tree must be available.
+func (pt *PartialTree) Iterate(fn func(key []byte, value []byte) bool) (stopped bool, err error) {
+	return pt.IterateRange(nil, nil, true, fn)
+}
+
+// IterateRange calls fn with each key/value pair in [start, end), in the given
+// order, until fn returns true. If either are nil, then it is open on that
+// side. fn isn't called unless the whole range is available.
+func (pt *PartialTree) IterateRange(start, end []byte, ascending bool, fn func(key []byte, value []byte) bool) (stopped bool, err error) {
+	if len(pt.root) == 0 {
+		return false, nil
+	}
+	var leaves []*partialNode
+	var walk func(hash []byte) error
+	walk = func(hash []byte) error {
+		node, err := pt.node(hash)
+		if err != nil {
+			return err
+		}
+		if node.height == 0 {
+			if (start == nil || bytes.Compare(node.key, start) >= 0) && (end == nil || bytes.Compare(node.key, end) < 0) {
+				if !node.hasValue {
+					return cmn.ErrorWrap(ErrNotAvailable, "value of key %X", node.key)
+				}
+				leaves = append(leaves, node)
+			}
+			return nil
+		}
+
+		// Keys under the left child are less than the node's key, and keys
+		// under the right child at least that.
+		visitLeft, visitRight := true, true
+		if node.key != nil {
+			visitLeft = start == nil || bytes.Compare(start, node.key) < 0
+			visitRight = end == nil || bytes.Compare(node.key, end) < 0
+		} else {
+			if right, ok := pt.nodes[string(node.rightHash)]; ok && right.bounded && start != nil {
+				visitLeft = bytes.Compare(start, right.minKey) < 0
+			}
+			if left, ok := pt.nodes[string(node.leftHash)]; ok && left.bounded && end != nil {
+				visitRight = bytes.Compare(left.maxKey, end) < 0
+			}
+		}
+		if visitLeft {
+			if err := walk(node.leftHash); err != nil {
+				return err
+			}
+		}
+		if visitRight {
+			return walk(node.rightHash)
+		}
+		return nil
+	}
+	if err := walk(pt.root); err != nil {
+		return false, err
+	}
+
+	for i := range leaves {
+		leaf := leaves[i]
+		if !ascending {
+			leaf = leaves[len(leaves)-1-i]
+		}
+		if fn(leaf.key, leaf.value) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+//----------------------------------------
+
+// pathToIndex returns the path to the leaf at the given index, which must be
+// in range, and the leaf.
+func (pt *PartialTree) pathToIndex(index int64) (PathToLeaf, *partialNode, error) {
+	node, err := pt.node(pt.root)
+	if err != nil {
+		return nil, nil, err
+	}
+	var path PathToLeaf
+	for node.height > 0 {
+		var leftSize int64
+		if left, ok := pt.nodes[string(node.leftHash)]; ok {
+			leftSize = left.size
+		} else if right, ok := pt.nodes[string(node.rightHash)]; ok {
+			leftSize = node.size - right.size
+		} else {
+			return nil, nil, cmn.ErrorWrap(ErrNotAvailable, "leaf at index %d", index)
+		}
+
+		pin := proofInnerNode{
+			Height:  node.height,
+			Size:    node.size,
+			Version: node.version,
+		}
+		next := node.leftHash
+		if index < leftSize {
+			pin.Right = node.rightHash
+		} else {
+			pin.Left = node.leftHash
+			next = node.rightHash
+			index -= leftSize
+		}
+		path = append(path, pin)
+		if node, err = pt.node(next); err != nil {
+			return nil, nil, err
+		}
+	}
+	return path, node, nil
+}
+
+// rangeProof returns a proof of the leaves from index from to index to, both
+// included, and the leaves.
+func (pt *PartialTree) rangeProof(from, to int64) (*RangeProof, []*partialNode, error) {
+	proof := &RangeProof{}
+	leaves := make([]*partialNode, 0, to-from+1)
+	for i := from; i <= to; i++ {
+		path, leaf, err := pt.pathToIndex(i)
+		if err != nil {
+			return nil, nil, err
+		}
+		if i == from {
+			proof.LeftPath = path
+		} else {
+			// The leaf is the leftmost one under the right child of the last
+			// node where its path goes right, which the proof derives from
+			// the previous leaf's path.
+			j := len(path) - 1
+			for j >= 0 && len(path[j].Left) == 0 {
+				j--
+			}
+			var inners PathToLeaf
+			if j+1 < len(path) {
+				inners = path[j+1:]
+			}
+			proof.InnerNodes = append(proof.InnerNodes, inners)
+		}
+		proof.Leaves = append(proof.Leaves, proofLeafNode{
+			Key:       leaf.key,
+			ValueHash: leaf.valueHash,
+			Version:   leaf.version,
+		})
+		leaves = append(leaves, leaf)
+	}
+	return proof, leaves, nil
+}
+
+// GetWithProof returns the value of the key, or nil if it doesn't exist, with
+// a proof of existence or absence, like ImmutableTree.GetWithProof.
+func (pt *PartialTree) GetWithProof(key []byte) (value []byte, proof *RangeProof, err error) {
+	size, err := pt.size()
+	if err != nil || size == 0 {
+		return nil, nil, err
+	}
+	index, leaf, err := pt.get(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch {
+	case leaf != nil:
+		if !leaf.hasValue {
+			return nil, nil, cmn.ErrorWrap(ErrNotAvailable, "value of key %X", key)
+		}
+		value = leaf.value
+		proof, _, err = pt.rangeProof(index, index)
+	case index == 0:
+		proof, _, err = pt.rangeProof(0, 0)
+	case index == size:
+		proof, _, err = pt.rangeProof(size-1, size-1)
+	default:
+		proof, _, err = pt.rangeProof(index-1, index)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return value, proof, nil
+}
+
+// rangeIndexes returns the indexes of the first and last leaves of a complete
+// proof of [start, end): the leaf before the range unless start exists, and
+// the leaf after it. The tree must not be empty.
+func (pt *PartialTree) rangeIndexes(start, end []byte) (from, to int64, err error) {
+	size, err := pt.size()
+	if err != nil {
+		return 0, 0, err
+	}
+	from, to = 0, size-1
+	if start != nil {
+		index, leaf, err := pt.get(start)
+		if err != nil {
+			return 0, 0, err
+		}
+		from = index
+		if leaf == nil && index > 0 {
+			from--
+		}
+	}
+	if end != nil {
+		index, _, err := pt.get(end)
+		if err != nil {
+			return 0, 0, err
+		}
+		if index < size {
+			to = index
+		}
+	}
+	return from, to, nil
+}
+
+// GetRangeWithCompleteProof returns all the key/value pairs in [start, end),
+// with a proof which also includes the leaves on either side of the range,
+// like ImmutableTree.GetRangeWithCompleteProof.
+func (pt *PartialTree) GetRangeWithCompleteProof(start, end []byte) (keys, values [][]byte, proof *RangeProof, err error) {
+	if start != nil && end != nil && bytes.Compare(start, end) >= 0 {
+		return nil, nil, nil, cmn.ErrorWrap(ErrInvalidInputs, "start key must be before end key")
+	}
+	if len(pt.root) == 0 {
+		return nil, nil, nil, nil
+	}
+	from, to, err := pt.rangeIndexes(start, end)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	proof, leaves, err := pt.rangeProof(from, to)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for _, leaf := range leaves {
+		if start != nil && bytes.Compare(leaf.key, start) < 0 || end != nil && bytes.Compare(leaf.key, end) >= 0 {
+			continue
+		}
+		if !leaf.hasValue {
+			return nil, nil, nil, cmn.ErrorWrap(ErrNotAvailable, "value of key %X", leaf.key)
+		}
+		keys = append(keys, leaf.key)
+		values = append(values, leaf.value)
+	}
+	return keys, values, proof, nil
+}
@@ -0,0 +1,143 @@
+package iavl
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	cmn "github.com/tendermint/tendermint/libs/common"
+	"github.com/tendermint/tendermint/libs/db"
+)
+
+func requireNotAvailable(t *testing.T, err error) {
+	require.Error(t, err)
+	require.Equal(t, ErrNotAvailable, err.(cmn.Error).Data(), err.Error())
+}
+
+func TestPartialTree(t *testing.T) {
+	require := require.New(t)
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	for i := 0; i < 200; i++ {
+		tree.Set([]byte{byte(i), 0x01}, []byte{byte(i)})
+	}
+	root, _, err := tree.SaveVersion()
+	require.NoError(err)
+
+	keys, values, proof, err := tree.GetRangeWithCompleteProof([]byte{50}, []byte{80})
+	require.NoError(err)
+	pt := NewPartialTree(root)
+	require.NoError(pt.AddRangeProof(proof, keys, values))
+	require.Equal(root, pt.Hash())
+
+	// Keys and values within the range, and the gaps between them.
+	for i := 50; i < 80; i++ {
+		for _, key := range [][]byte{{byte(i), 0x01}, {byte(i), 0x02}, {byte(i)}} {
+			index, value, err := pt.Get(key)
+			require.NoError(err)
+			expIndex, expValue := tree.Get(key)
+			require.Equal(expIndex, index)
+			require.Equal(expValue, value)
+			has, err := pt.Has(key)
+			require.NoError(err)
+			require.Equal(tree.Has(key), has)
+
+			value, proof, err := pt.GetWithProof(key)
+			require.NoError(err)
+			require.NoError(proof.Verify(root))
+			if value != nil {
+				require.NoError(proof.VerifyItem(key, value))
+			} else {
+				require.NoError(proof.VerifyAbsence(key))
+			}
+		}
+	}
+
+	// The leaves on either side of the range are proven, but not their values.
+	has, err := pt.Has([]byte{49, 0x01})
+	require.NoError(err)
+	require.True(has)
+	_, _, err = pt.Get([]byte{49, 0x01})
+	requireNotAvailable(t, err)
+	_, _, err = pt.Get([]byte{10, 0x01})
+	requireNotAvailable(t, err)
+	_, err = pt.Has([]byte{100})
+	requireNotAvailable(t, err)
+	_, _, err = pt.GetWithProof([]byte{150})
+	requireNotAvailable(t, err)
+
+	// Iteration within the range.
+	expected := [][]byte{}
+	tree.IterateRange([]byte{55}, []byte{70, 0x02}, false, func(key, value []byte) bool {
+		expected = append(expected, key, value)
+		return false
+	})
+	got := [][]byte{}
+	stopped, err := pt.IterateRange([]byte{55}, []byte{70, 0x02}, false, func(key, value []byte) bool {
+		got = append(got, key, value)
+		return false
+	})
+	require.NoError(err)
+	require.False(stopped)
+	require.Equal(expected, got)
+	_, err = pt.IterateRange([]byte{55}, []byte{90}, true, func(key, value []byte) bool {
+		t.Fatal("fn must not be called")
+		return true
+	})
+	requireNotAvailable(t, err)
+	_, err = pt.Iterate(func(key, value []byte) bool { return false })
+	requireNotAvailable(t, err)
+
+	// Range proofs of sub-ranges.
+	for _, r := range [][2][]byte{{{50, 0x01}, {80}}, {{60}, {61}}, {{60, 0x01}, {60, 0x02}}, {{70, 0x05}, {79, 0x01}}} {
+		keys, values, proof, err := pt.GetRangeWithCompleteProof(r[0], r[1])
+		require.NoError(err)
+		expKeys, expValues, _, err := tree.GetRangeWithCompleteProof(r[0], r[1])
+		require.NoError(err)
+		require.Equal(expKeys, keys)
+		require.Equal(expValues, values)
+		require.NoError(proof.Verify(root))
+		require.NoError(proof.VerifyRange(r[0], r[1], keys, values))
+	}
+	_, _, _, err = pt.GetRangeWithCompleteProof([]byte{40}, []byte{60})
+	requireNotAvailable(t, err)
+
+	// Adding the end of the tree, without values.
+	_, proof, err = tree.GetWithProof([]byte{250})
+	require.NoError(err)
+	require.NoError(pt.AddRangeProof(proof, nil, nil))
+	has, err = pt.Has([]byte{250})
+	require.NoError(err)
+	require.False(has)
+	_, _, err = pt.Get([]byte{199, 0x01})
+	requireNotAvailable(t, err)
+	_, err = pt.Has([]byte{198, 0x02})
+	requireNotAvailable(t, err)
+
+	// A witness adds the nodes read through a tree.
+	itree, err := tree.GetImmutable(tree.Version())
+	require.NoError(err)
+	itree.StartTracing()
+	_, value := itree.Get([]byte{120, 0x01})
+	require.NoError(pt.AddWitness(itree.StopTracing()))
+	_, got1, err := pt.Get([]byte{120, 0x01})
+	require.NoError(err)
+	require.Equal(value, got1)
+
+	// Proofs of other trees and wrong values are rejected.
+	require.Error(pt.AddRangeProof(proof, [][]byte{{250}}, [][]byte{{1}}))
+	_, _, proof, err = tree.GetRangeWithCompleteProof([]byte{10}, []byte{20})
+	require.NoError(err)
+	require.Error(pt.AddRangeProof(proof, [][]byte{{10, 0x01}}, [][]byte{{11}}))
+	tree.Set([]byte{1}, []byte{1})
+	_, _, proof, err = tree.ImmutableTree.GetRangeWithCompleteProof([]byte{10}, []byte{20})
+	require.NoError(err)
+	require.Error(pt.AddRangeProof(proof, nil, nil))
+
+	// The empty tree.
+	pt = NewPartialTree(nil)
+	has, err = pt.Has([]byte{1})
+	require.NoError(err)
+	require.False(has)
+	_, proof, err = pt.GetWithProof([]byte{1})
+	require.NoError(err)
+	require.Nil(proof)
+}
@@ -4,20 +4,20 @@ import (
 	"bytes"
 	"fmt"
 
-	"github.com/tendermint/go-amino"
-	"github.com/tendermint/tendermint/crypto/tmhash"
 	cmn "github.com/tendermint/tendermint/libs/common"
+
+	"github.com/tendermint/iavl/verifier"
 )
 
 var (
 	// ErrInvalidProof is returned by Verify when a proof cannot be validated.
-	ErrInvalidProof = fmt.Errorf("invalid proof")
+	ErrInvalidProof = verifier.ErrInvalidProof
 
 	// ErrInvalidInputs is returned when the inputs passed to the function are invalid.
-	ErrInvalidInputs = fmt.Errorf("invalid inputs")
+	ErrInvalidInputs = verifier.ErrInvalidInputs
 
 	// ErrInvalidRoot is returned when the root passed in does not match the proof's.
-	ErrInvalidRoot = fmt.Errorf("invalid root")
+	ErrInvalidRoot = verifier.ErrInvalidRoot
 )
 
 //----------------------------------------
@@ -51,38 +51,7 @@ func (pin proofInnerNode) stringIndented(indent string) string {
 }
 
 func (pin proofInnerNode) Hash(childHash []byte) []byte {
-	hasher := tmhash.New()
-	buf := new(bytes.Buffer)
-
-	err := amino.EncodeInt8(buf, pin.Height)
-	if err == nil {
-		err = amino.EncodeVarint(buf, pin.Size)
-	}
-	if err == nil {
-		err = amino.EncodeVarint(buf, pin.Version)
-	}
-
-	if len(pin.Left) == 0 {
-		if err == nil {
-			err = amino.EncodeByteSlice(buf, childHash)
-		}
-		if err == nil {
-			err = amino.EncodeByteSlice(buf, pin.Right)
-		}
-	} else {
-		if err == nil {
-			err = amino.EncodeByteSlice(buf, pin.Left)
-		}
-		if err == nil {
-			err = amino.EncodeByteSlice(buf, childHash)
-		}
-	}
-	if err != nil {
-		panic(fmt.Sprintf("Failed to hash proofInnerNode: %v", err))
-	}
-
-	hasher.Write(buf.Bytes())
-	return hasher.Sum(nil)
+	return verifier.InnerNode(pin).Hash(childHash)
 }
 
 //----------------------------------------
@@ -110,28 +79,15 @@ func (pln proofLeafNode) stringIndented(indent string) string {
 }
 
 func (pln proofLeafNode) Hash() []byte {
-	hasher := tmhash.New()
-	buf := new(bytes.Buffer)
+	return pln.toVerifier().Hash()
+}
 
-	err := amino.EncodeInt8(buf, 0)
-	if err == nil {
-		err = amino.EncodeVarint(buf, 1)
-	}
-	if err == nil {
-		err = amino.EncodeVarint(buf, pln.Version)
-	}
-	if err == nil {
-		err = amino.EncodeByteSlice(buf, pln.Key)
-	}
-	if err == nil {
-		err = amino.EncodeByteSlice(buf, pln.ValueHash)
+func (pln proofLeafNode) toVerifier() verifier.LeafNode {
+	return verifier.LeafNode{
+		Key:       verifier.HexBytes(pln.Key),
+		ValueHash: verifier.HexBytes(pln.ValueHash),
+		Version:   pln.Version,
 	}
-	if err != nil {
-		panic(fmt.Sprintf("Failed to hash proofLeafNode: %v", err))
-	}
-	hasher.Write(buf.Bytes())
-
-	return hasher.Sum(nil)
 }
 
 //----------------------------------------
@@ -181,3 +137,35 @@ func (node *Node) pathToLeaf(t *ImmutableTree, key []byte, path *PathToLeaf) (*N
 	n, err := node.getRightNode(t).pathToLeaf(t, key, path)
 	return n, err
 }
+
+// pathToIndex is like pathToLeaf, but looks up the leaf at the given index
+// under the node, which must be in range.
+func (node *Node) pathToIndex(t *ImmutableTree, index int64, path *PathToLeaf) *Node {
+	if node.height == 0 {
+		return node
+	}
+
+	leftNode := node.getLeftNode(t)
+	if index < leftNode.size {
+		// left side
+		pin := proofInnerNode{
+			Height:  node.height,
+			Size:    node.size,
+			Version: node.version,
+			Left:    nil,
+			Right:   node.getRightNode(t).hash,
+		}
+		*path = append(*path, pin)
+		return leftNode.pathToIndex(t, index, path)
+	}
+	// right side
+	pin := proofInnerNode{
+		Height:  node.height,
+		Size:    node.size,
+		Version: node.version,
+		Left:    leftNode.hash,
+		Right:   nil,
+	}
+	*path = append(*path, pin)
+	return node.getRightNode(t).pathToIndex(t, index-leftNode.size, path)
+}
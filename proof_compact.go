@@ -0,0 +1,370 @@
+package iavl
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/tendermint/tendermint/crypto/tmhash"
+	cmn "github.com/tendermint/tendermint/libs/common"
+)
+
+// compactProofVersion is the first byte of a compact range proof.
+const compactProofVersion = 1
+
+// The compact encoding of a range proof is, in order:
+//
+//   - the version byte, then the number of leaves as a uvarint;
+//   - each path, LeftPath first and then InnerNodes: its length as a uvarint,
+//     a bitmap with the bit of each node set if its left hash is given, and
+//     the height, size and version of each node as varints of the difference
+//     from the previous node of the path;
+//   - each leaf: the length of the prefix it shares with the previous key and
+//     the length of the rest as uvarints, the rest of the key, the value hash
+//     and the version as a varint;
+//   - the hashes of the paths, in the same order, leaving out the right hashes
+//     which are the roots of the subtrees holding the following leaves, as
+//     they're derived from them.
+//
+// All hashes must be tmhash.Size bytes long.
+
+// MarshalCompact returns the compact encoding of the proof, which is much
+// smaller than its amino encoding. The proof must be well-formed.
+func (proof *RangeProof) MarshalCompact() ([]byte, error) {
+	if proof == nil {
+		return nil, cmn.ErrorWrap(ErrInvalidProof, "proof is nil")
+	}
+	if len(proof.Leaves) == 0 || len(proof.InnerNodes)+1 != len(proof.Leaves) {
+		return nil, cmn.ErrorWrap(ErrInvalidProof, "InnerNodes vs Leaves length mismatch, leaves should be 1 more.")
+	}
+	derived := make(map[*proofInnerNode]bool)
+	err := proof.walkRights(true, func(pin *proofInnerNode, right []byte) error {
+		if !bytes.Equal(pin.Right, right) {
+			return cmn.ErrorWrap(ErrInvalidRoot, "intermediate root hash %X doesn't match, got %X", pin.Right, right)
+		}
+		derived[pin] = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	w := new(compactWriter)
+	w.WriteByte(compactProofVersion)
+	w.uvarint(uint64(len(proof.Leaves)))
+
+	paths := proof.paths()
+	for _, path := range paths {
+		w.uvarint(uint64(len(path)))
+		bitmap := make([]byte, (len(path)+7)/8)
+		for i, pin := range path {
+			if len(pin.Left) > 0 {
+				bitmap[i/8] |= 1 << uint(i%8)
+			}
+		}
+		w.Write(bitmap)
+		var prev proofInnerNode
+		for _, pin := range path {
+			if (len(pin.Left) == 0) == (len(pin.Right) == 0) {
+				return nil, cmn.ErrorWrap(ErrInvalidProof, "inner node must have exactly one of left and right hashes")
+			}
+			w.varint(int64(pin.Height) - int64(prev.Height))
+			w.varint(pin.Size - prev.Size)
+			w.varint(pin.Version - prev.Version)
+			prev = pin
+		}
+	}
+
+	var prevKey []byte
+	for _, leaf := range proof.Leaves {
+		shared := 0
+		for shared < len(prevKey) && shared < len(leaf.Key) && prevKey[shared] == leaf.Key[shared] {
+			shared++
+		}
+		w.uvarint(uint64(shared))
+		w.uvarint(uint64(len(leaf.Key) - shared))
+		w.Write(leaf.Key[shared:])
+		if err := w.hash(leaf.ValueHash); err != nil {
+			return nil, err
+		}
+		w.varint(leaf.Version)
+		prevKey = leaf.Key
+	}
+
+	for _, path := range paths {
+		for i := range path {
+			pin := &path[i]
+			var err error
+			if len(pin.Left) > 0 {
+				err = w.hash(pin.Left)
+			} else if !derived[pin] {
+				err = w.hash(pin.Right)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return w.Bytes(), nil
+}
+
+// UnmarshalCompactRangeProof decodes a range proof encoded with
+// RangeProof.MarshalCompact.
+func UnmarshalCompactRangeProof(bz []byte) (*RangeProof, error) {
+	r := &compactReader{bz: bz}
+	if version := r.byte(); r.err == nil && version != compactProofVersion {
+		return nil, cmn.NewError("unknown compact proof version %d", version)
+	}
+	// Every leaf takes at least tmhash.Size bytes, which bounds allocations.
+	numLeaves := r.uvarint()
+	if r.err == nil && (numLeaves == 0 || numLeaves > uint64(len(r.bz))/tmhash.Size) {
+		return nil, cmn.ErrorWrap(ErrInvalidProof, "invalid number of leaves %d", numLeaves)
+	}
+
+	proof := &RangeProof{}
+	for i := uint64(0); i < numLeaves && r.err == nil; i++ {
+		path := r.path()
+		if i == 0 {
+			proof.LeftPath = path
+		} else {
+			proof.InnerNodes = append(proof.InnerNodes, path)
+		}
+	}
+
+	var prevKey []byte
+	for i := uint64(0); i < numLeaves && r.err == nil; i++ {
+		shared := r.uvarint()
+		if shared > uint64(len(prevKey)) {
+			r.fail("shared key prefix too long")
+			break
+		}
+		rest := r.bytes(r.uvarint())
+		key := append(append([]byte{}, prevKey[:shared]...), rest...)
+		if i > 0 && bytes.Compare(prevKey, key) >= 0 {
+			r.fail("keys out of order")
+			break
+		}
+		valueHash := r.bytes(tmhash.Size)
+		version := r.varint()
+		proof.Leaves = append(proof.Leaves, proofLeafNode{Key: key, ValueHash: valueHash, Version: version})
+		prevKey = key
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	// Right hashes are set to a placeholder until they're read or derived.
+	derived := make(map[*proofInnerNode]bool)
+	err := proof.walkRights(false, func(pin *proofInnerNode, _ []byte) error {
+		derived[pin] = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range proof.paths() {
+		for i := range path {
+			pin := &path[i]
+			if len(pin.Left) > 0 {
+				pin.Left = r.bytes(tmhash.Size)
+			} else if !derived[pin] {
+				pin.Right = r.bytes(tmhash.Size)
+			}
+		}
+	}
+	if r.err == nil && len(r.bz) > 0 {
+		r.fail("%d trailing bytes", len(r.bz))
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	err = proof.walkRights(true, func(pin *proofInnerNode, right []byte) error {
+		pin.Right = right
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return proof, nil
+}
+
+// paths returns the left path followed by the inner node paths.
+func (proof *RangeProof) paths() []PathToLeaf {
+	return append([]PathToLeaf{proof.LeftPath}, proof.InnerNodes...)
+}
+
+// walkRights walks the proof like _computeRootHash, calling fn with each inner
+// node whose right hash is the root of the subtree holding the following
+// leaves. If hash is set, right is that root computed from the leaves, which
+// fn may store in the node.
+func (proof *RangeProof) walkRights(hash bool, fn func(pin *proofInnerNode, right []byte) error) error {
+	leaves := proof.Leaves
+	innersq := proof.InnerNodes
+
+	var walk func(path PathToLeaf) ([]byte, error)
+	walk = func(path PathToLeaf) ([]byte, error) {
+		leaf := leaves[0]
+		leaves = leaves[1:]
+		var h []byte
+		if hash {
+			h = leaf.Hash()
+		}
+
+		for i := len(path) - 1; i >= 0; i-- {
+			pin := &path[i]
+			if len(pin.Right) > 0 && len(leaves) > 0 {
+				if len(innersq) == 0 {
+					return nil, cmn.ErrorWrap(ErrInvalidProof, "missing inner nodes")
+				}
+				inners := innersq[0]
+				innersq = innersq[1:]
+				right, err := walk(inners)
+				if err != nil {
+					return nil, err
+				}
+				if err := fn(pin, right); err != nil {
+					return nil, err
+				}
+			}
+			if hash {
+				h = pin.Hash(h)
+			}
+		}
+		return h, nil
+	}
+
+	if len(leaves) == 0 {
+		return cmn.ErrorWrap(ErrInvalidProof, "no leaves")
+	}
+	if _, err := walk(proof.LeftPath); err != nil {
+		return err
+	}
+	if len(leaves) > 0 || len(innersq) > 0 {
+		return cmn.ErrorWrap(ErrInvalidProof, "left over leaves -- malformed proof")
+	}
+	return nil
+}
+
+//----------------------------------------
+
+type compactWriter struct {
+	bytes.Buffer
+}
+
+func (w *compactWriter) uvarint(u uint64) {
+	var bz [binary.MaxVarintLen64]byte
+	w.Write(bz[:binary.PutUvarint(bz[:], u)])
+}
+
+func (w *compactWriter) varint(i int64) {
+	var bz [binary.MaxVarintLen64]byte
+	w.Write(bz[:binary.PutVarint(bz[:], i)])
+}
+
+func (w *compactWriter) hash(hash []byte) error {
+	if len(hash) != tmhash.Size {
+		return cmn.ErrorWrap(ErrInvalidProof, "hash %X is not %d bytes long", hash, tmhash.Size)
+	}
+	w.Write(hash)
+	return nil
+}
+
+// compactReader reads a compact proof, keeping the first error.
+type compactReader struct {
+	bz  []byte
+	err error
+}
+
+func (r *compactReader) fail(format string, args ...interface{}) {
+	if r.err == nil {
+		r.err = cmn.ErrorWrap(ErrInvalidProof, "decoding compact proof: "+format, args...)
+	}
+}
+
+func (r *compactReader) byte() byte {
+	bz := r.bytes(1)
+	if bz == nil {
+		return 0
+	}
+	return bz[0]
+}
+
+func (r *compactReader) bytes(n uint64) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > uint64(len(r.bz)) {
+		r.fail("unexpected end of input")
+		return nil
+	}
+	bz := make([]byte, n)
+	copy(bz, r.bz)
+	r.bz = r.bz[n:]
+	return bz
+}
+
+func (r *compactReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	u, n := binary.Uvarint(r.bz)
+	if n <= 0 {
+		r.fail("invalid uvarint")
+		return 0
+	}
+	r.bz = r.bz[n:]
+	return u
+}
+
+func (r *compactReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	i, n := binary.Varint(r.bz)
+	if n <= 0 {
+		r.fail("invalid varint")
+		return 0
+	}
+	r.bz = r.bz[n:]
+	return i
+}
+
+// path reads a path, with placeholder hashes on the side given by its bitmap.
+func (r *compactReader) path() PathToLeaf {
+	// Every node takes at least three bytes.
+	length := r.uvarint()
+	if r.err == nil && length > uint64(len(r.bz))/3 {
+		r.fail("invalid path length %d", length)
+	}
+	bitmap := r.bytes((length + 7) / 8)
+	if r.err != nil || length == 0 {
+		return nil
+	}
+	if length%8 != 0 && bitmap[len(bitmap)-1]>>(length%8) != 0 {
+		r.fail("unused bitmap bits set")
+		return nil
+	}
+
+	path := make(PathToLeaf, 0, length)
+	var prev proofInnerNode
+	for i := uint64(0); i < length && r.err == nil; i++ {
+		height := int64(prev.Height) + r.varint()
+		pin := proofInnerNode{
+			Height:  int8(height),
+			Size:    prev.Size + r.varint(),
+			Version: prev.Version + r.varint(),
+		}
+		if height <= 0 || height > 127 || pin.Size < 2 {
+			r.fail("invalid inner node")
+			break
+		}
+		placeholder := make([]byte, tmhash.Size)
+		if bitmap[i/8]&(1<<(i%8)) != 0 {
+			pin.Left = placeholder
+		} else {
+			pin.Right = placeholder
+		}
+		path = append(path, pin)
+		prev = pin
+	}
+	return path
+}
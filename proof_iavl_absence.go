@@ -72,10 +72,9 @@ func (op IAVLAbsenceOp) Run(args [][]byte) ([][]byte, error) {
 	if err != nil {
 		return nil, cmn.ErrorWrap(err, "computing root hash")
 	}
-	// XXX What is the encoding for keys?
-	// We should decode the key depending on whether it's a string or hex,
-	// maybe based on quotes and 0x prefix?
-	err = op.Proof.VerifyAbsence([]byte(op.key))
+	// The key is the raw key, as decoded from the key path by
+	// merkle.KeyPathToKeys. See KeyPath.
+	err = op.Proof.VerifyAbsence(op.key)
 	if err != nil {
 		return nil, cmn.ErrorWrap(err, "verifying absence")
 	}
@@ -0,0 +1,427 @@
+package iavl
+
+import (
+	"bytes"
+
+	"github.com/tendermint/go-amino"
+	"github.com/tendermint/tendermint/crypto/tmhash"
+	cmn "github.com/tendermint/tendermint/libs/common"
+)
+
+// The types below are a language-neutral form of IAVL proofs, following the
+// ICS 23 commitment proof format: hash operations are plain byte strings to
+// be concatenated around the child hash, so that a verifier only needs
+// SHA-256 and a protobuf-style varint. See PROOF_SPEC.md for the layout.
+
+// HashOp is a hash function applied by a proof operation. The values match
+// the ICS 23 HashOp enum.
+type HashOp int32
+
+const (
+	HashOpNoHash HashOp = 0
+	HashOpSHA256 HashOp = 1
+)
+
+// LengthOp is the length prefix applied to data before it is hashed. The
+// values match the ICS 23 LengthOp enum.
+type LengthOp int32
+
+const (
+	LengthOpNoPrefix LengthOp = 0
+	LengthOpVarProto LengthOp = 1 // Unsigned protobuf varint of the length.
+)
+
+// LeafOp describes how a leaf is hashed, which is
+// Hash(Prefix | Length(PrehashKey(key)) | Length(PrehashValue(value))).
+type LeafOp struct {
+	Hash         HashOp   `json:"hash"`
+	PrehashKey   HashOp   `json:"prehash_key"`
+	PrehashValue HashOp   `json:"prehash_value"`
+	Length       LengthOp `json:"length"`
+	Prefix       []byte   `json:"prefix"`
+}
+
+// InnerOp describes how an inner node is hashed from the hash of one of its
+// children, which is Hash(Prefix | child | Suffix).
+type InnerOp struct {
+	Hash   HashOp `json:"hash"`
+	Prefix []byte `json:"prefix"`
+	Suffix []byte `json:"suffix"`
+}
+
+// ExistenceProof proves that a key has a value. The path is ordered from the
+// leaf up to the root.
+type ExistenceProof struct {
+	Key   []byte     `json:"key"`
+	Value []byte     `json:"value"`
+	Leaf  *LeafOp    `json:"leaf"`
+	Path  []*InnerOp `json:"path"`
+}
+
+// NonExistenceProof proves that a key is absent, with the existence of its
+// neighbors. Left is nil if the key is before the first key of the tree, and
+// Right is nil if it's after the last one.
+type NonExistenceProof struct {
+	Key   []byte          `json:"key"`
+	Left  *ExistenceProof `json:"left"`
+	Right *ExistenceProof `json:"right"`
+}
+
+// CommitmentProof holds either an existence or a non-existence proof.
+type CommitmentProof struct {
+	Exist    *ExistenceProof    `json:"exist,omitempty"`
+	Nonexist *NonExistenceProof `json:"nonexist,omitempty"`
+}
+
+// Every inner node prefix ends with the length of the child hash, and
+// proofInnerNode hashes are always of this size.
+const (
+	ics23HashLength = tmhash.Size
+	ics23HashPrefix = byte(tmhash.Size)
+)
+
+//----------------------------------------
+
+// convertLeafOp returns the leaf operation for a proof leaf.
+func convertLeafOp(leaf proofLeafNode) *LeafOp {
+	buf := new(bytes.Buffer)
+	err := amino.EncodeInt8(buf, 0)
+	if err == nil {
+		err = amino.EncodeVarint(buf, 1)
+	}
+	if err == nil {
+		err = amino.EncodeVarint(buf, leaf.Version)
+	}
+	if err != nil {
+		panic(err)
+	}
+	return &LeafOp{
+		Hash:         HashOpSHA256,
+		PrehashKey:   HashOpNoHash,
+		PrehashValue: HashOpSHA256,
+		Length:       LengthOpVarProto,
+		Prefix:       buf.Bytes(),
+	}
+}
+
+// convertInnerOp returns the inner operation for a proof inner node.
+func convertInnerOp(pin proofInnerNode) *InnerOp {
+	prefix := new(bytes.Buffer)
+	err := amino.EncodeInt8(prefix, pin.Height)
+	if err == nil {
+		err = amino.EncodeVarint(prefix, pin.Size)
+	}
+	if err == nil {
+		err = amino.EncodeVarint(prefix, pin.Version)
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	// The child hash is length prefixed like the sibling hash.
+	suffix := new(bytes.Buffer)
+	if len(pin.Left) == 0 {
+		prefix.WriteByte(ics23HashPrefix)
+		err = amino.EncodeByteSlice(suffix, pin.Right)
+	} else {
+		err = amino.EncodeByteSlice(prefix, pin.Left)
+		prefix.WriteByte(ics23HashPrefix)
+	}
+	if err != nil {
+		panic(err)
+	}
+	return &InnerOp{
+		Hash:   HashOpSHA256,
+		Prefix: prefix.Bytes(),
+		Suffix: suffix.Bytes(),
+	}
+}
+
+// convertPath returns the inner operations for a path, from the leaf up.
+func convertPath(path PathToLeaf) []*InnerOp {
+	ops := make([]*InnerOp, 0, len(path))
+	for i := len(path) - 1; i >= 0; i-- {
+		ops = append(ops, convertInnerOp(path[i]))
+	}
+	return ops
+}
+
+// leafPaths returns the full path from the root to each of the proof's
+// leaves. Expects the proof to be well-formed.
+func (proof *RangeProof) leafPaths() []PathToLeaf {
+	paths := make([]PathToLeaf, 0, len(proof.Leaves))
+	innersq := proof.InnerNodes
+
+	// prefix is the path to the root of the subtree holding the next leaf,
+	// and path the rest of the path to it.
+	var walk func(prefix, path PathToLeaf)
+	walk = func(prefix, path PathToLeaf) {
+		leaf := proof.Leaves[len(paths)]
+		paths = append(paths, append(append(PathToLeaf(nil), prefix...), path...))
+
+		// Climb back up, descending into each right sibling which holds
+		// the following leaves.
+		hash := leaf.Hash()
+		for i := len(path) - 1; i >= 0 && len(paths) < len(proof.Leaves); i-- {
+			pin := path[i]
+			if len(pin.Right) > 0 {
+				inners := innersq[0]
+				innersq = innersq[1:]
+
+				right := pin
+				right.Left, right.Right = hash, nil
+				subPrefix := append(append(PathToLeaf(nil), prefix...), path[:i]...)
+				walk(append(subPrefix, right), inners)
+			}
+			hash = pin.Hash(hash)
+		}
+	}
+	walk(nil, proof.LeftPath)
+	return paths
+}
+
+// ConvertExistenceProof converts the proof of a key in a range proof into an
+// ExistenceProof, for the given value.
+func ConvertExistenceProof(proof *RangeProof, key, value []byte) (*ExistenceProof, error) {
+	if proof == nil {
+		return nil, cmn.ErrorWrap(ErrInvalidProof, "proof is nil")
+	}
+	if _, _, err := proof._computeRootHash(); err != nil {
+		return nil, err
+	}
+	for i, path := range proof.leafPaths() {
+		leaf := proof.Leaves[i]
+		if !bytes.Equal(leaf.Key, key) {
+			continue
+		}
+		if !bytes.Equal(leaf.ValueHash, tmhash.Sum(value)) {
+			return nil, cmn.ErrorWrap(ErrInvalidInputs, "leaf value hash not same")
+		}
+		return &ExistenceProof{
+			Key:   key,
+			Value: value,
+			Leaf:  convertLeafOp(leaf),
+			Path:  convertPath(path),
+		}, nil
+	}
+	return nil, cmn.ErrorWrap(ErrInvalidInputs, "leaf key not found in proof")
+}
+
+// GetCommitmentProof returns an existence proof for key if it exists, or a
+// non-existence proof with its neighbors if it doesn't.
+func (t *ImmutableTree) GetCommitmentProof(key []byte) (*CommitmentProof, error) {
+	value, proof, err := t.GetWithProof(key)
+	if err != nil {
+		return nil, err
+	}
+	if proof == nil {
+		return nil, cmn.NewError("cannot prove keys in an empty tree")
+	}
+	if value != nil {
+		exist, err := ConvertExistenceProof(proof, key, value)
+		if err != nil {
+			return nil, err
+		}
+		return &CommitmentProof{Exist: exist}, nil
+	}
+
+	nonexist := &NonExistenceProof{Key: key}
+	for _, leaf := range proof.Leaves {
+		_, value := t.Get(leaf.Key)
+		exist, err := ConvertExistenceProof(proof, leaf.Key, value)
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Compare(leaf.Key, key) < 0 {
+			nonexist.Left = exist
+		} else if nonexist.Right == nil {
+			nonexist.Right = exist
+		}
+	}
+	return &CommitmentProof{Nonexist: nonexist}, nil
+}
+
+//----------------------------------------
+
+// Calculate returns the root hash committed to by the proof.
+func (p *ExistenceProof) Calculate() ([]byte, error) {
+	if p == nil || p.Leaf == nil {
+		return nil, cmn.ErrorWrap(ErrInvalidProof, "proof or leaf is nil")
+	}
+	if err := p.Leaf.checkIAVL(); err != nil {
+		return nil, err
+	}
+
+	buf := new(bytes.Buffer)
+	buf.Write(p.Leaf.Prefix)
+	if err := amino.EncodeByteSlice(buf, p.Key); err != nil {
+		return nil, cmn.ErrorWrap(err, "writing key")
+	}
+	if err := amino.EncodeByteSlice(buf, tmhash.Sum(p.Value)); err != nil {
+		return nil, cmn.ErrorWrap(err, "writing value hash")
+	}
+	hash := tmhash.Sum(buf.Bytes())
+
+	for i, op := range p.Path {
+		if _, err := op.childIsLeft(); err != nil {
+			return nil, cmn.ErrorWrap(err, "inner op %d", i)
+		}
+		hash = tmhash.Sum(append(append(append([]byte(nil), op.Prefix...), hash...), op.Suffix...))
+	}
+	return hash, nil
+}
+
+// Verify checks that the proof proves key has value under root.
+func (p *ExistenceProof) Verify(root, key, value []byte) error {
+	if p == nil {
+		return cmn.ErrorWrap(ErrInvalidProof, "proof is nil")
+	}
+	if !bytes.Equal(p.Key, key) {
+		return cmn.ErrorWrap(ErrInvalidProof, "proof is for key %X, not %X", p.Key, key)
+	}
+	if !bytes.Equal(p.Value, value) {
+		return cmn.ErrorWrap(ErrInvalidProof, "value not same")
+	}
+	hash, err := p.Calculate()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(hash, root) {
+		return cmn.ErrorWrap(ErrInvalidRoot, "root hash doesn't match")
+	}
+	return nil
+}
+
+// Verify checks that the proof proves key is absent under root.
+func (p *NonExistenceProof) Verify(root, key []byte) error {
+	if p == nil || (p.Left == nil && p.Right == nil) {
+		return cmn.ErrorWrap(ErrInvalidProof, "proof has no neighbors")
+	}
+	if !bytes.Equal(p.Key, key) {
+		return cmn.ErrorWrap(ErrInvalidProof, "proof is for key %X, not %X", p.Key, key)
+	}
+	if p.Left != nil {
+		if bytes.Compare(p.Left.Key, key) >= 0 {
+			return cmn.ErrorWrap(ErrInvalidProof, "left neighbor isn't before key")
+		}
+		if err := p.Left.Verify(root, p.Left.Key, p.Left.Value); err != nil {
+			return cmn.ErrorWrap(err, "verifying left neighbor")
+		}
+	}
+	if p.Right != nil {
+		if bytes.Compare(p.Right.Key, key) <= 0 {
+			return cmn.ErrorWrap(ErrInvalidProof, "right neighbor isn't after key")
+		}
+		if err := p.Right.Verify(root, p.Right.Key, p.Right.Value); err != nil {
+			return cmn.ErrorWrap(err, "verifying right neighbor")
+		}
+	}
+
+	switch {
+	case p.Left == nil:
+		if !allChildren(p.Right.Path, true) {
+			return cmn.ErrorWrap(ErrInvalidProof, "right neighbor isn't the first key")
+		}
+	case p.Right == nil:
+		if !allChildren(p.Left.Path, false) {
+			return cmn.ErrorWrap(ErrInvalidProof, "left neighbor isn't the last key")
+		}
+	default:
+		if !areNeighbors(p.Left.Path, p.Right.Path) {
+			return cmn.ErrorWrap(ErrInvalidProof, "neighbors aren't adjacent")
+		}
+	}
+	return nil
+}
+
+// checkIAVL checks that the leaf operation is the one used by IAVL.
+func (op *LeafOp) checkIAVL() error {
+	if op.Hash != HashOpSHA256 || op.PrehashKey != HashOpNoHash ||
+		op.PrehashValue != HashOpSHA256 || op.Length != LengthOpVarProto {
+		return cmn.ErrorWrap(ErrInvalidProof, "unexpected leaf op")
+	}
+	// The prefix holds the height, size and version.
+	height, n, err := amino.DecodeInt8(op.Prefix)
+	if err != nil || height != 0 {
+		return cmn.ErrorWrap(ErrInvalidProof, "leaf op prefix must have height 0")
+	}
+	size, m, err := amino.DecodeVarint(op.Prefix[n:])
+	if err != nil || size != 1 {
+		return cmn.ErrorWrap(ErrInvalidProof, "leaf op prefix must have size 1")
+	}
+	if _, k, err := amino.DecodeVarint(op.Prefix[n+m:]); err != nil || n+m+k != len(op.Prefix) {
+		return cmn.ErrorWrap(ErrInvalidProof, "leaf op prefix must end with the version")
+	}
+	return nil
+}
+
+// childIsLeft checks that the inner operation is the one used by IAVL, and
+// returns whether the child hash is the left one.
+func (op *InnerOp) childIsLeft() (bool, error) {
+	if op == nil || op.Hash != HashOpSHA256 {
+		return false, cmn.ErrorWrap(ErrInvalidProof, "unexpected inner op")
+	}
+	// The prefix starts with the height, size and version.
+	height, n, err := amino.DecodeInt8(op.Prefix)
+	if err != nil || height <= 0 {
+		return false, cmn.ErrorWrap(ErrInvalidProof, "inner op prefix must have a positive height")
+	}
+	_, m, err := amino.DecodeVarint(op.Prefix[n:])
+	if err != nil {
+		return false, cmn.ErrorWrap(ErrInvalidProof, "inner op prefix must have a size")
+	}
+	_, k, err := amino.DecodeVarint(op.Prefix[n+m:])
+	if err != nil {
+		return false, cmn.ErrorWrap(ErrInvalidProof, "inner op prefix must have a version")
+	}
+	rest := op.Prefix[n+m+k:]
+
+	switch {
+	case len(rest) == 1 && rest[0] == ics23HashPrefix &&
+		len(op.Suffix) == 1+ics23HashLength && op.Suffix[0] == ics23HashPrefix:
+		return true, nil
+	case len(rest) == 2+ics23HashLength && rest[0] == ics23HashPrefix && rest[len(rest)-1] == ics23HashPrefix &&
+		len(op.Suffix) == 0:
+		return false, nil
+	}
+	return false, cmn.ErrorWrap(ErrInvalidProof, "malformed inner op")
+}
+
+// allChildren returns whether every inner operation in the path takes the
+// child on the left if left is set, or on the right otherwise.
+func allChildren(path []*InnerOp, left bool) bool {
+	for _, op := range path {
+		isLeft, err := op.childIsLeft()
+		if err != nil || isLeft != left {
+			return false
+		}
+	}
+	return true
+}
+
+// areNeighbors returns whether the leaves of the left and right paths are
+// adjacent. Both paths must lead to the same root.
+func areNeighbors(left, right []*InnerOp) bool {
+	// Drop the common ancestors, from the root down.
+	for len(left) > 0 && len(right) > 0 &&
+		bytes.Equal(left[len(left)-1].Prefix, right[len(right)-1].Prefix) &&
+		bytes.Equal(left[len(left)-1].Suffix, right[len(right)-1].Suffix) {
+		left, right = left[:len(left)-1], right[:len(right)-1]
+	}
+	if len(left) == 0 || len(right) == 0 {
+		return false
+	}
+
+	// The paths split at the lowest common ancestor, with the left leaf
+	// being the last one of its left subtree, and the right leaf the first
+	// one of its right subtree.
+	leftIsLeft, err := left[len(left)-1].childIsLeft()
+	if err != nil || !leftIsLeft {
+		return false
+	}
+	rightIsLeft, err := right[len(right)-1].childIsLeft()
+	if err != nil || rightIsLeft {
+		return false
+	}
+	return allChildren(left[:len(left)-1], false) && allChildren(right[:len(right)-1], true)
+}
@@ -0,0 +1,258 @@
+package iavl
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	cmn "github.com/tendermint/tendermint/libs/common"
+)
+
+// The protobuf encoding of the ICS 23 proofs follows the messages of the same
+// name in the ICS 23 proofs.proto, with the same field numbers. As in proto3,
+// zero enums and empty byte strings are omitted.
+
+// Protobuf wire types.
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+// Marshal returns the protobuf encoding of the proof, as an ICS 23
+// CommitmentProof message.
+func (p *CommitmentProof) Marshal() ([]byte, error) {
+	if p == nil || (p.Exist == nil) == (p.Nonexist == nil) {
+		return nil, cmn.ErrorWrap(ErrInvalidProof, "proof must hold exactly one of exist and nonexist")
+	}
+	w := new(protoWriter)
+	if p.Exist != nil {
+		w.message(1, p.Exist.marshal())
+	} else {
+		w.message(2, p.Nonexist.marshal())
+	}
+	return w.Bytes(), nil
+}
+
+// Unmarshal decodes the protobuf encoding of an ICS 23 CommitmentProof
+// message into the proof. Batch proofs aren't supported.
+func (p *CommitmentProof) Unmarshal(bz []byte) error {
+	*p = CommitmentProof{}
+	err := readProto(bz, func(field int, _ uint64, data []byte) error {
+		switch field {
+		case 1:
+			p.Exist, p.Nonexist = new(ExistenceProof), nil
+			return p.Exist.unmarshal(data)
+		case 2:
+			p.Exist, p.Nonexist = nil, new(NonExistenceProof)
+			return p.Nonexist.unmarshal(data)
+		case 3, 4:
+			return cmn.NewError("batch proofs are not supported")
+		}
+		return nil
+	})
+	if err != nil {
+		return cmn.ErrorWrap(err, "decoding CommitmentProof")
+	}
+	if p.Exist == nil && p.Nonexist == nil {
+		return cmn.NewError("decoding CommitmentProof: no proof")
+	}
+	return nil
+}
+
+func (p *ExistenceProof) marshal() []byte {
+	w := new(protoWriter)
+	w.bytes(1, p.Key)
+	w.bytes(2, p.Value)
+	if p.Leaf != nil {
+		w.message(3, p.Leaf.marshal())
+	}
+	for _, op := range p.Path {
+		w.message(4, op.marshal())
+	}
+	return w.Bytes()
+}
+
+func (p *ExistenceProof) unmarshal(bz []byte) error {
+	return readProto(bz, func(field int, _ uint64, data []byte) error {
+		switch field {
+		case 1:
+			p.Key = data
+		case 2:
+			p.Value = data
+		case 3:
+			p.Leaf = new(LeafOp)
+			return p.Leaf.unmarshal(data)
+		case 4:
+			op := new(InnerOp)
+			p.Path = append(p.Path, op)
+			return op.unmarshal(data)
+		}
+		return nil
+	})
+}
+
+func (p *NonExistenceProof) marshal() []byte {
+	w := new(protoWriter)
+	w.bytes(1, p.Key)
+	if p.Left != nil {
+		w.message(2, p.Left.marshal())
+	}
+	if p.Right != nil {
+		w.message(3, p.Right.marshal())
+	}
+	return w.Bytes()
+}
+
+func (p *NonExistenceProof) unmarshal(bz []byte) error {
+	return readProto(bz, func(field int, _ uint64, data []byte) error {
+		switch field {
+		case 1:
+			p.Key = data
+		case 2:
+			p.Left = new(ExistenceProof)
+			return p.Left.unmarshal(data)
+		case 3:
+			p.Right = new(ExistenceProof)
+			return p.Right.unmarshal(data)
+		}
+		return nil
+	})
+}
+
+func (op *LeafOp) marshal() []byte {
+	w := new(protoWriter)
+	w.varint(1, int64(op.Hash))
+	w.varint(2, int64(op.PrehashKey))
+	w.varint(3, int64(op.PrehashValue))
+	w.varint(4, int64(op.Length))
+	w.bytes(5, op.Prefix)
+	return w.Bytes()
+}
+
+func (op *LeafOp) unmarshal(bz []byte) error {
+	return readProto(bz, func(field int, value uint64, data []byte) error {
+		switch field {
+		case 1:
+			op.Hash = HashOp(value)
+		case 2:
+			op.PrehashKey = HashOp(value)
+		case 3:
+			op.PrehashValue = HashOp(value)
+		case 4:
+			op.Length = LengthOp(value)
+		case 5:
+			op.Prefix = data
+		}
+		return nil
+	})
+}
+
+func (op *InnerOp) marshal() []byte {
+	w := new(protoWriter)
+	w.varint(1, int64(op.Hash))
+	w.bytes(2, op.Prefix)
+	w.bytes(3, op.Suffix)
+	return w.Bytes()
+}
+
+func (op *InnerOp) unmarshal(bz []byte) error {
+	return readProto(bz, func(field int, value uint64, data []byte) error {
+		switch field {
+		case 1:
+			op.Hash = HashOp(value)
+		case 2:
+			op.Prefix = data
+		case 3:
+			op.Suffix = data
+		}
+		return nil
+	})
+}
+
+//----------------------------------------
+
+// protoWriter writes the fields of a protobuf message.
+type protoWriter struct {
+	bytes.Buffer
+}
+
+func (w *protoWriter) uvarint(v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	w.Write(buf[:n])
+}
+
+func (w *protoWriter) tag(field int, wireType int) {
+	w.uvarint(uint64(field)<<3 | uint64(wireType))
+}
+
+// varint writes an int32, int64 or enum field, unless it is zero.
+func (w *protoWriter) varint(field int, v int64) {
+	if v != 0 {
+		w.tag(field, protoVarint)
+		w.uvarint(uint64(v))
+	}
+}
+
+// bytes writes a bytes field, unless it is empty.
+func (w *protoWriter) bytes(field int, bz []byte) {
+	if len(bz) > 0 {
+		w.message(field, bz)
+	}
+}
+
+// message writes an embedded message field, even if it is empty.
+func (w *protoWriter) message(field int, bz []byte) {
+	w.tag(field, protoBytes)
+	w.uvarint(uint64(len(bz)))
+	w.Write(bz)
+}
+
+// readProto calls fn with each field of a protobuf message, along with its
+// value if it is a varint, or its data if it is length delimited. Fields of
+// other wire types are skipped.
+func readProto(bz []byte, fn func(field int, value uint64, data []byte) error) error {
+	for len(bz) > 0 {
+		tag, n := binary.Uvarint(bz)
+		if n <= 0 || tag>>3 == 0 {
+			return cmn.NewError("invalid field tag")
+		}
+		bz = bz[n:]
+		field, wireType := int(tag>>3), int(tag&7)
+
+		var value uint64
+		var data []byte
+		switch wireType {
+		case protoVarint:
+			value, n = binary.Uvarint(bz)
+			if n <= 0 {
+				return cmn.NewError("invalid varint in field %d", field)
+			}
+			bz = bz[n:]
+		case protoBytes:
+			size, n := binary.Uvarint(bz)
+			if n <= 0 || size > uint64(len(bz)-n) {
+				return cmn.NewError("invalid length in field %d", field)
+			}
+			data = append([]byte(nil), bz[n:n+int(size)]...)
+			bz = bz[n+int(size):]
+		case protoFixed64, protoFixed32:
+			size := 8
+			if wireType == protoFixed32 {
+				size = 4
+			}
+			if len(bz) < size {
+				return cmn.NewError("truncated field %d", field)
+			}
+			bz = bz[size:]
+			continue
+		default:
+			return cmn.NewError("unsupported wire type %d in field %d", wireType, field)
+		}
+		if err := fn(field, value, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+package iavl
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/tendermint/tendermint/crypto/tmhash"
+	cmn "github.com/tendermint/tendermint/libs/common"
+)
+
+// ProofJSONVersion is the version of the canonical JSON encoding of proofs,
+// described in PROOF_SPEC.md.
+const ProofJSONVersion = 1
+
+// ProofJSONTypeRange is the type of a bare RangeProof in its JSON encoding.
+// Proof operators use their ProofOp type.
+const ProofJSONTypeRange = "iavl:range_proof"
+
+// proofJSON is the envelope of every proof. Key is set for proof operators,
+// and End for IAVLRangeOp ranges which aren't open at the end.
+type proofJSON struct {
+	Version int             `json:"version"`
+	Type    string          `json:"type"`
+	Key     *cmn.HexBytes   `json:"key,omitempty"`
+	End     *cmn.HexBytes   `json:"end,omitempty"`
+	Proof   *rangeProofJSON `json:"proof"`
+}
+
+type rangeProofJSON struct {
+	LeftPath   []innerNodeJSON   `json:"left_path"`
+	InnerNodes [][]innerNodeJSON `json:"inner_nodes"`
+	Leaves     []leafNodeJSON    `json:"leaves"`
+}
+
+// 64-bit integers are encoded as strings, which JavaScript can't lose
+// precision on.
+type innerNodeJSON struct {
+	Height  int8         `json:"height"`
+	Size    int64        `json:"size,string"`
+	Version int64        `json:"version,string"`
+	Left    cmn.HexBytes `json:"left"`
+	Right   cmn.HexBytes `json:"right"`
+}
+
+type leafNodeJSON struct {
+	Key       cmn.HexBytes `json:"key"`
+	ValueHash cmn.HexBytes `json:"value_hash"`
+	Version   int64        `json:"version,string"`
+}
+
+// MarshalProofJSON returns the canonical JSON encoding of a *RangeProof, an
+// IAVLValueOp, an IAVLAbsenceOp or an IAVLRangeOp.
+func MarshalProofJSON(proof interface{}) ([]byte, error) {
+	pj := proofJSON{Version: ProofJSONVersion}
+	var rangeProof *RangeProof
+	switch p := proof.(type) {
+	case *RangeProof:
+		if p == nil {
+			return nil, cmn.ErrorWrap(ErrInvalidProof, "proof is nil")
+		}
+		pj.Type, rangeProof = ProofJSONTypeRange, p
+	case IAVLValueOp:
+		pj.Type, pj.Key, rangeProof = ProofOpIAVLValue, hexBytesPtr(p.key), p.Proof
+	case IAVLAbsenceOp:
+		pj.Type, pj.Key, rangeProof = ProofOpIAVLAbsence, hexBytesPtr(p.key), p.Proof
+	case IAVLRangeOp:
+		pj.Type, pj.Key, rangeProof = ProofOpIAVLRange, hexBytesPtr(p.start), p.Proof
+		if p.End != nil {
+			pj.End = hexBytesPtr(p.End)
+		}
+	default:
+		return nil, cmn.NewError("cannot encode %T as a proof", proof)
+	}
+	if rangeProof != nil {
+		pj.Proof = newRangeProofJSON(rangeProof)
+		if _, err := pj.Proof.toRangeProof(); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(pj)
+}
+
+// UnmarshalProofJSON decodes a proof encoded with MarshalProofJSON, into a
+// *RangeProof, an IAVLValueOp, an IAVLAbsenceOp or an IAVLRangeOp. It fails
+// unless bz is valid and in the canonical form, so that a proof has a single
+// encoding.
+func UnmarshalProofJSON(bz []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(bz))
+	dec.DisallowUnknownFields()
+	var pj proofJSON
+	if err := dec.Decode(&pj); err != nil {
+		return nil, cmn.ErrorWrap(err, "decoding proof JSON")
+	}
+	if pj.Version != ProofJSONVersion {
+		return nil, cmn.NewError("unknown proof JSON version %d", pj.Version)
+	}
+
+	var rangeProof *RangeProof
+	if pj.Proof != nil {
+		var err error
+		rangeProof, err = pj.Proof.toRangeProof()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if pj.Type != ProofJSONTypeRange && pj.Key == nil {
+		return nil, cmn.ErrorWrap(ErrInvalidProof, "%v proof has no key", pj.Type)
+	}
+	if pj.End != nil && pj.Type != ProofOpIAVLRange {
+		return nil, cmn.ErrorWrap(ErrInvalidProof, "%v proof can't have an end", pj.Type)
+	}
+
+	var proof interface{}
+	switch pj.Type {
+	case ProofJSONTypeRange:
+		if pj.Key != nil || rangeProof == nil {
+			return nil, cmn.ErrorWrap(ErrInvalidProof, "range proof must have a proof and no key")
+		}
+		proof = rangeProof
+	case ProofOpIAVLValue:
+		proof = NewIAVLValueOp(*pj.Key, rangeProof)
+	case ProofOpIAVLAbsence:
+		proof = NewIAVLAbsenceOp(*pj.Key, rangeProof)
+	case ProofOpIAVLRange:
+		var end []byte
+		if pj.End != nil {
+			end = *pj.End
+		}
+		proof = NewIAVLRangeOp(*pj.Key, end, rangeProof)
+	default:
+		return nil, cmn.NewError("unknown proof JSON type %q", pj.Type)
+	}
+
+	canonical, err := MarshalProofJSON(proof)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(canonical, bz) {
+		return nil, cmn.NewError("proof JSON is not in canonical form")
+	}
+	return proof, nil
+}
+
+func hexBytesPtr(bz []byte) *cmn.HexBytes {
+	hbz := cmn.HexBytes(bz)
+	return &hbz
+}
+
+func newRangeProofJSON(proof *RangeProof) *rangeProofJSON {
+	pj := &rangeProofJSON{
+		LeftPath:   newPathJSON(proof.LeftPath),
+		InnerNodes: make([][]innerNodeJSON, 0, len(proof.InnerNodes)),
+		Leaves:     make([]leafNodeJSON, 0, len(proof.Leaves)),
+	}
+	for _, path := range proof.InnerNodes {
+		pj.InnerNodes = append(pj.InnerNodes, newPathJSON(path))
+	}
+	for _, leaf := range proof.Leaves {
+		pj.Leaves = append(pj.Leaves, leafNodeJSON{
+			Key:       leaf.Key,
+			ValueHash: leaf.ValueHash,
+			Version:   leaf.Version,
+		})
+	}
+	return pj
+}
+
+func newPathJSON(path PathToLeaf) []innerNodeJSON {
+	pj := make([]innerNodeJSON, 0, len(path))
+	for _, pin := range path {
+		pj = append(pj, innerNodeJSON{
+			Height:  pin.Height,
+			Size:    pin.Size,
+			Version: pin.Version,
+			Left:    pin.Left,
+			Right:   pin.Right,
+		})
+	}
+	return pj
+}
+
+// toRangeProof validates the proof's fields and converts it. It doesn't
+// verify any hashes.
+func (pj *rangeProofJSON) toRangeProof() (*RangeProof, error) {
+	if len(pj.Leaves) == 0 || len(pj.InnerNodes)+1 != len(pj.Leaves) {
+		return nil, cmn.ErrorWrap(ErrInvalidProof, "InnerNodes vs Leaves length mismatch, leaves should be 1 more.")
+	}
+	proof := &RangeProof{}
+	var err error
+	if proof.LeftPath, err = pathFromJSON(pj.LeftPath); err != nil {
+		return nil, err
+	}
+	for _, path := range pj.InnerNodes {
+		inners, err := pathFromJSON(path)
+		if err != nil {
+			return nil, err
+		}
+		proof.InnerNodes = append(proof.InnerNodes, inners)
+	}
+	for i, leaf := range pj.Leaves {
+		if len(leaf.ValueHash) != tmhash.Size {
+			return nil, cmn.ErrorWrap(ErrInvalidProof, "leaf value hash must be %d bytes", tmhash.Size)
+		}
+		if leaf.Version < 0 {
+			return nil, cmn.ErrorWrap(ErrInvalidProof, "leaf version must not be negative")
+		}
+		if i > 0 && bytes.Compare(pj.Leaves[i-1].Key, leaf.Key) >= 0 {
+			return nil, cmn.ErrorWrap(ErrInvalidProof, "leaves must be in key order")
+		}
+		proof.Leaves = append(proof.Leaves, proofLeafNode{
+			Key:       []byte(leaf.Key),
+			ValueHash: []byte(leaf.ValueHash),
+			Version:   leaf.Version,
+		})
+	}
+	return proof, nil
+}
+
+// pathFromJSON validates and converts a path. Empty paths and hashes are nil,
+// as in proofs from the tree.
+func pathFromJSON(pj []innerNodeJSON) (PathToLeaf, error) {
+	if len(pj) == 0 {
+		return nil, nil
+	}
+	path := make(PathToLeaf, 0, len(pj))
+	for _, pin := range pj {
+		if pin.Height <= 0 || pin.Size < 2 || pin.Version < 0 {
+			return nil, cmn.ErrorWrap(ErrInvalidProof, "invalid inner node height, size or version")
+		}
+		switch {
+		case len(pin.Left) == 0 && len(pin.Right) == tmhash.Size:
+			pin.Left = nil
+		case len(pin.Right) == 0 && len(pin.Left) == tmhash.Size:
+			pin.Right = nil
+		default:
+			return nil, cmn.ErrorWrap(ErrInvalidProof, "inner node must have one %d byte hash, left or right", tmhash.Size)
+		}
+		path = append(path, proofInnerNode{
+			Height:  pin.Height,
+			Size:    pin.Size,
+			Version: pin.Version,
+			Left:    []byte(pin.Left),
+			Right:   []byte(pin.Right),
+		})
+	}
+	return path, nil
+}
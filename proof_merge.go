@@ -0,0 +1,69 @@
+package iavl
+
+import (
+	"bytes"
+
+	cmn "github.com/tendermint/tendermint/libs/common"
+)
+
+// MergeRangeProofs returns a proof of the leaves of both proofs, which must be
+// proofs of the same tree whose leaves overlap or are adjacent.
+func MergeRangeProofs(a, b *RangeProof) (*RangeProof, error) {
+	if a == nil || b == nil {
+		return nil, cmn.ErrorWrap(ErrInvalidProof, "proof is nil")
+	}
+	root, err := a.computeRootHash()
+	if err != nil {
+		return nil, err
+	}
+	pt := NewPartialTree(root)
+	if err := pt.AddRangeProof(a, nil, nil); err != nil {
+		return nil, err
+	}
+	if err := pt.AddRangeProof(b, nil, nil); err != nil {
+		return nil, cmn.ErrorWrap(err, "proofs are not of the same tree")
+	}
+
+	aFrom, bFrom := a.LeftIndex(), b.LeftIndex()
+	aTo, bTo := aFrom+int64(len(a.Leaves))-1, bFrom+int64(len(b.Leaves))-1
+	if aFrom > bTo+1 || bFrom > aTo+1 {
+		return nil, cmn.ErrorWrap(ErrInvalidInputs, "proofs of leaves %d to %d and %d to %d are not adjacent",
+			aFrom, aTo, bFrom, bTo)
+	}
+	if bFrom < aFrom {
+		aFrom = bFrom
+	}
+	if bTo > aTo {
+		aTo = bTo
+	}
+	proof, _, err := pt.rangeProof(aFrom, aTo)
+	return proof, err
+}
+
+// SubRangeProof returns a proof of the pairs in [start, end) extracted from
+// the proof, which also includes the leaves on either side of the range, as
+// proofs from GetRangeWithCompleteProof do. If either are nil, then it is
+// open on that side. It fails with ErrNotAvailable unless the proof includes
+// all of those leaves.
+func (proof *RangeProof) SubRangeProof(start, end []byte) (*RangeProof, error) {
+	if proof == nil {
+		return nil, cmn.ErrorWrap(ErrInvalidProof, "proof is nil")
+	}
+	if start != nil && end != nil && bytes.Compare(start, end) >= 0 {
+		return nil, cmn.ErrorWrap(ErrInvalidInputs, "start key must be before end key")
+	}
+	root, err := proof.computeRootHash()
+	if err != nil {
+		return nil, err
+	}
+	pt := NewPartialTree(root)
+	if err := pt.AddRangeProof(proof, nil, nil); err != nil {
+		return nil, err
+	}
+	from, to, err := pt.rangeIndexes(start, end)
+	if err != nil {
+		return nil, err
+	}
+	sub, _, err := pt.rangeProof(from, to)
+	return sub, err
+}
@@ -6,6 +6,8 @@ import (
 	"strings"
 
 	cmn "github.com/tendermint/tendermint/libs/common"
+
+	"github.com/tendermint/iavl/verifier"
 )
 
 // pathWithLeaf is a path to a leaf node and the leaf node itself.
@@ -99,6 +101,14 @@ func (pl PathToLeaf) computeRootHash(leafHash []byte) []byte {
 	return hash
 }
 
+func (pl PathToLeaf) toVerifier() verifier.PathToLeaf {
+	vpath := make(verifier.PathToLeaf, 0, len(pl))
+	for _, pin := range pl {
+		vpath = append(vpath, verifier.InnerNode(pin))
+	}
+	return vpath
+}
+
 func (pl PathToLeaf) isLeftmost() bool {
 	for _, node := range pl {
 		if len(node.Left) > 0 {
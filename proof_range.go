@@ -8,6 +8,8 @@ import (
 
 	"github.com/tendermint/tendermint/crypto/tmhash"
 	cmn "github.com/tendermint/tendermint/libs/common"
+
+	"github.com/tendermint/iavl/verifier"
 )
 
 type RangeProof struct {
@@ -19,9 +21,9 @@ type RangeProof struct {
 
 	// memoize
 	rootVerified bool
-	rootHash     []byte // valid iff rootVerified is true
-	treeEnd      bool   // valid iff rootVerified is true
-
+	rootHash     []byte               // valid iff rootVerified is true
+	treeEnd      bool                 // valid iff rootVerified is true
+	vproof       *verifier.RangeProof // valid iff rootVerified is true
 }
 
 // Keys returns all the keys in the RangeProof.  NOTE: The keys here may
@@ -92,82 +94,99 @@ func (proof *RangeProof) LeftIndex() int64 {
 // Verify that a key has some value.
 // Does not assume that the proof itself is valid, call Verify() first.
 func (proof *RangeProof) VerifyItem(key, value []byte) error {
-	leaves := proof.Leaves
 	if proof == nil {
 		return cmn.ErrorWrap(ErrInvalidProof, "proof is nil")
 	}
 	if !proof.rootVerified {
 		return cmn.NewError("must call Verify(root) first.")
 	}
-	i := sort.Search(len(leaves), func(i int) bool {
-		return bytes.Compare(key, leaves[i].Key) <= 0
-	})
-	if i >= len(leaves) || !bytes.Equal(leaves[i].Key, key) {
-		return cmn.ErrorWrap(ErrInvalidProof, "leaf key not found in proof")
+	return fromVerifierError(proof.vproof.VerifyItem(key, value))
+}
+
+// VerifyItemAt is like VerifyItem, and also verifies that the key is at the
+// given index of the tree. The index is derived from the sizes of the inner
+// nodes on the left path, which are part of their hashes.
+// Does not assume that the proof itself is valid, call Verify() first.
+func (proof *RangeProof) VerifyItemAt(index int64, key, value []byte) error {
+	if err := proof.VerifyItem(key, value); err != nil {
+		return err
+	}
+	leftIndex := proof.LeftIndex()
+	if leftIndex < 0 {
+		return cmn.ErrorWrap(ErrInvalidProof, "invalid left path")
 	}
-	valueHash := tmhash.Sum(value)
-	if !bytes.Equal(leaves[i].ValueHash, valueHash) {
-		return cmn.ErrorWrap(ErrInvalidProof, "leaf value hash not same")
+	// Leaves are adjacent, so the key's index follows from its position.
+	i := sort.Search(len(proof.Leaves), func(i int) bool {
+		return bytes.Compare(key, proof.Leaves[i].Key) <= 0
+	})
+	if leftIndex+int64(i) != index {
+		return cmn.ErrorWrap(ErrInvalidProof, "leaf is at index %d, not %d", leftIndex+int64(i), index)
 	}
 	return nil
 }
 
-// Verify that proof is valid absence proof for key.
-// Does not assume that the proof itself is valid.
-// For that, use Verify(root).
-func (proof *RangeProof) VerifyAbsence(key []byte) error {
+// VerifyRange verifies that keys and values are all the key/value pairs in
+// [start, end), in order. If either are nil, then it is open on that side.
+// The proof must include the leaves on either side of the range, unless the
+// range reaches the end of the tree, as proofs from GetRangeWithCompleteProof
+// do. Does not assume that the proof itself is valid, call Verify() first.
+func (proof *RangeProof) VerifyRange(start, end []byte, keys, values [][]byte) error {
 	if proof == nil {
 		return cmn.ErrorWrap(ErrInvalidProof, "proof is nil")
 	}
 	if !proof.rootVerified {
 		return cmn.NewError("must call Verify(root) first.")
 	}
-	cmp := bytes.Compare(key, proof.Leaves[0].Key)
-	if cmp < 0 {
-		if proof.LeftPath.isLeftmost() {
-			return nil
-		} else {
-			return cmn.NewError("absence not proved by left path")
-		}
-	} else if cmp == 0 {
-		return cmn.NewError("absence disproved via first item #0")
+	if len(keys) != len(values) {
+		return cmn.ErrorWrap(ErrInvalidInputs, "got %d keys and %d values", len(keys), len(values))
 	}
-	if len(proof.LeftPath) == 0 {
-		return nil // proof ok
+
+	// The leaves are adjacent, so they cover the range if they reach past
+	// both its ends.
+	first, last := proof.Leaves[0], proof.Leaves[len(proof.Leaves)-1]
+	if !proof.LeftPath.isLeftmost() && (start == nil || bytes.Compare(first.Key, start) > 0) {
+		return cmn.ErrorWrap(ErrInvalidProof, "start of range not covered by left path")
 	}
-	if proof.LeftPath.isRightmost() {
-		return nil
+	if !proof.treeEnd && (end == nil || bytes.Compare(last.Key, end) < 0) {
+		return cmn.ErrorWrap(ErrInvalidProof, "end of range not covered by last leaf")
 	}
 
-	// See if any of the leaves are greater than key.
-	for i := 1; i < len(proof.Leaves); i++ {
-		leaf := proof.Leaves[i]
-		cmp := bytes.Compare(key, leaf.Key)
-		if cmp < 0 {
-			return nil // proof ok
-		} else if cmp == 0 {
-			return cmn.NewError("absence disproved via item #%v", i)
-		} else {
-			if i == len(proof.Leaves)-1 {
-				// If last item, check whether
-				// it's the last item in teh tree.
-
-			}
+	i := 0
+	for _, leaf := range proof.Leaves {
+		if start != nil && bytes.Compare(leaf.Key, start) < 0 {
 			continue
 		}
+		if end != nil && bytes.Compare(leaf.Key, end) >= 0 {
+			break
+		}
+		if i >= len(keys) {
+			return cmn.ErrorWrap(ErrInvalidProof, "key %X missing from range", leaf.Key)
+		}
+		if !bytes.Equal(leaf.Key, keys[i]) {
+			return cmn.ErrorWrap(ErrInvalidProof, "expected key %X at position %d, got %X", leaf.Key, i, keys[i])
+		}
+		if !bytes.Equal(leaf.ValueHash, tmhash.Sum(values[i])) {
+			return cmn.ErrorWrap(ErrInvalidProof, "leaf value hash not same for key %X", keys[i])
+		}
+		i++
 	}
-
-	// It's still a valid proof if our last leaf is the rightmost child.
-	if proof.treeEnd {
-		return nil // OK!
+	if i != len(keys) {
+		return cmn.ErrorWrap(ErrInvalidProof, "key %X not found in range", keys[i])
 	}
+	return nil
+}
 
-	// It's not a valid absence proof.
-	if len(proof.Leaves) < 2 {
-		return cmn.NewError("absence not proved by right leaf (need another leaf?)")
-	} else {
-		return cmn.NewError("absence not proved by right leaf")
+// Verify that proof is valid absence proof for key.
+// Does not assume that the proof itself is valid.
+// For that, use Verify(root).
+func (proof *RangeProof) VerifyAbsence(key []byte) error {
+	if proof == nil {
+		return cmn.ErrorWrap(ErrInvalidProof, "proof is nil")
 	}
+	if !proof.rootVerified {
+		return cmn.NewError("must call Verify(root) first.")
+	}
+	return fromVerifierError(proof.vproof.VerifyAbsence(key))
 }
 
 // Verify that proof is valid.
@@ -180,19 +199,14 @@ func (proof *RangeProof) Verify(root []byte) error {
 }
 
 func (proof *RangeProof) verify(root []byte) (err error) {
-	rootHash := proof.rootHash
-	if rootHash == nil {
-		derivedHash, err := proof.computeRootHash()
-		if err != nil {
-			return err
-		}
-		rootHash = derivedHash
-	}
-	if !bytes.Equal(rootHash, root) {
-		return cmn.ErrorWrap(ErrInvalidRoot, "root hash doesn't match")
-	} else {
-		proof.rootVerified = true
-	}
+	vproof := proof.toVerifier()
+	if err := vproof.Verify(root); err != nil {
+		return fromVerifierError(err)
+	}
+	proof.rootVerified = true
+	proof.rootHash = root
+	proof.treeEnd = vproof.TreeEnd()
+	proof.vproof = vproof
 	return nil
 }
 
@@ -217,89 +231,37 @@ func (proof *RangeProof) computeRootHash() (rootHash []byte, err error) {
 }
 
 func (proof *RangeProof) _computeRootHash() (rootHash []byte, treeEnd bool, err error) {
-	if len(proof.Leaves) == 0 {
-		return nil, false, cmn.ErrorWrap(ErrInvalidProof, "no leaves")
+	rootHash, treeEnd, err = proof.toVerifier().ComputeRootHash()
+	return rootHash, treeEnd, fromVerifierError(err)
+}
+
+// toVerifier converts the proof for the verifier package, which computes its
+// root hash.
+func (proof *RangeProof) toVerifier() *verifier.RangeProof {
+	vproof := &verifier.RangeProof{
+		LeftPath:   proof.LeftPath.toVerifier(),
+		InnerNodes: make([]verifier.PathToLeaf, 0, len(proof.InnerNodes)),
+		Leaves:     make([]verifier.LeafNode, 0, len(proof.Leaves)),
 	}
-	if len(proof.InnerNodes)+1 != len(proof.Leaves) {
-		return nil, false, cmn.ErrorWrap(ErrInvalidProof, "InnerNodes vs Leaves length mismatch, leaves should be 1 more.")
+	for _, path := range proof.InnerNodes {
+		vproof.InnerNodes = append(vproof.InnerNodes, path.toVerifier())
 	}
-
-	// Start from the left path and prove each leaf.
-
-	// shared across recursive calls
-	var leaves = proof.Leaves
-	var innersq = proof.InnerNodes
-	var COMPUTEHASH func(path PathToLeaf, rightmost bool) (hash []byte, treeEnd bool, done bool, err error)
-
-	// rightmost: is the root a rightmost child of the tree?
-	// treeEnd: true iff the last leaf is the last item of the tree.
-	// Returns the (possibly intermediate, possibly root) hash.
-	COMPUTEHASH = func(path PathToLeaf, rightmost bool) (hash []byte, treeEnd bool, done bool, err error) {
-
-		// Pop next leaf.
-		nleaf, rleaves := leaves[0], leaves[1:]
-		leaves = rleaves
-
-		// Compute hash.
-		hash = (pathWithLeaf{
-			Path: path,
-			Leaf: nleaf,
-		}).computeRootHash()
-
-		// If we don't have any leaves left, we're done.
-		if len(leaves) == 0 {
-			rightmost = rightmost && path.isRightmost()
-			return hash, rightmost, true, nil
-		}
-
-		// Prove along path (until we run out of leaves).
-		for len(path) > 0 {
-
-			// Drop the leaf-most (last-most) inner nodes from path
-			// until we encounter one with a left hash.
-			// We assume that the left side is already verified.
-			// rpath: rest of path
-			// lpath: last path item
-			rpath, lpath := path[:len(path)-1], path[len(path)-1]
-			path = rpath
-			if len(lpath.Right) == 0 {
-				continue
-			}
-
-			// Pop next inners, a PathToLeaf (e.g. []proofInnerNode).
-			inners, rinnersq := innersq[0], innersq[1:]
-			innersq = rinnersq
-
-			// Recursively verify inners against remaining leaves.
-			derivedRoot, treeEnd, done, err := COMPUTEHASH(inners, rightmost && rpath.isRightmost())
-			if err != nil {
-				return nil, treeEnd, false, cmn.ErrorWrap(err, "recursive COMPUTEHASH call")
-			}
-			if !bytes.Equal(derivedRoot, lpath.Right) {
-				return nil, treeEnd, false, cmn.ErrorWrap(ErrInvalidRoot, "intermediate root hash %X doesn't match, got %X", lpath.Right, derivedRoot)
-			}
-			if done {
-				return hash, treeEnd, true, nil
-			}
-		}
-
-		// We're not done yet (leaves left over). No error, not done either.
-		// Technically if rightmost, we know there's an error "left over leaves
-		// -- malformed proof", but we return that at the top level, below.
-		return hash, false, false, nil
+	for _, leaf := range proof.Leaves {
+		vproof.Leaves = append(vproof.Leaves, leaf.toVerifier())
 	}
+	return vproof
+}
 
-	// Verify!
-	path := proof.LeftPath
-	rootHash, treeEnd, done, err := COMPUTEHASH(path, true)
-	if err != nil {
-		return nil, treeEnd, cmn.ErrorWrap(err, "root COMPUTEHASH call")
-	} else if !done {
-		return nil, treeEnd, cmn.ErrorWrap(ErrInvalidProof, "left over leaves -- malformed proof")
+// fromVerifierError returns the errors of the verifier package as errors of
+// this one, whose cause is the matching error of proof.go.
+func fromVerifierError(err error) error {
+	if err == nil {
+		return nil
 	}
-
-	// Ok!
-	return rootHash, treeEnd, nil
+	if verr, ok := err.(*verifier.Error); ok {
+		return cmn.ErrorWrap(verr.Err, "%s", verr.Msg)
+	}
+	return cmn.NewError("%s", err.Error())
 }
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -358,8 +320,10 @@ func (t *ImmutableTree) getRangeProof(keyStart, keyEnd []byte, limit int) (proof
 		}, keys, values, nil
 	}
 
-	// Get the key after left.key to iterate from.
-	afterLeft := cpIncr(left.key)
+	// Get the key after left.key to iterate from. This is left.key with a
+	// zero byte appended, since there can be keys between left.key and
+	// cpIncr(left.key).
+	afterLeft := append(cp(left.key), 0x00)
 
 	// Traverse starting from afterLeft, until keyEnd or the next leaf
 	// after keyEnd.
@@ -460,16 +424,62 @@ func (t *ImmutableTree) GetWithProof(key []byte) (value []byte, proof *RangeProo
 	return nil, proof, nil
 }
 
+// GetByIndexWithProof gets the key and value at the specified index. A proof
+// binding them to the index is returned alongside, which can be checked with
+// RangeProof.VerifyItemAt.
+func (t *ImmutableTree) GetByIndexWithProof(index int64) (key, value []byte, proof *RangeProof, err error) {
+	if t.root == nil || index < 0 || index >= t.root.size {
+		return nil, nil, nil, cmn.NewError("index %d out of range", index)
+	}
+	t.root.hashWithCount() // Ensure that all hashes are calculated.
+
+	path := PathToLeaf(nil)
+	leaf := t.root.pathToIndex(t, index, &path)
+	proof = &RangeProof{
+		LeftPath: path,
+		Leaves: []proofLeafNode{{
+			Key:       leaf.key,
+			ValueHash: tmhash.Sum(leaf.value),
+			Version:   leaf.version,
+		}},
+	}
+	return leaf.key, leaf.value, proof, nil
+}
+
 // GetRangeWithProof gets key/value pairs within the specified range and limit.
 func (t *ImmutableTree) GetRangeWithProof(startKey []byte, endKey []byte, limit int) (keys, values [][]byte, proof *RangeProof, err error) {
 	proof, keys, values, err = t.getRangeProof(startKey, endKey, limit)
 	return
 }
 
+// GetRangeWithCompleteProof gets all the key/value pairs in [startKey, endKey),
+// with a proof which also includes the leaves on either side of the range, so
+// that RangeProof.VerifyRange can check that no pairs were left out. If either
+// are nil, then it is open on that side. The proof is nil for an empty tree.
+func (t *ImmutableTree) GetRangeWithCompleteProof(startKey, endKey []byte) (keys, values [][]byte, proof *RangeProof, err error) {
+	if startKey != nil && endKey != nil && bytes.Compare(startKey, endKey) >= 0 {
+		return nil, nil, nil, cmn.ErrorWrap(ErrInvalidInputs, "start key must be before end key")
+	}
+	// Fetch the leaf before the range if startKey doesn't exist, the pairs in
+	// the range and the leaf after it.
+	limit := int(t.CountRange(startKey, endKey)) + 2
+	proof, keys, values, err = t.getRangeProof(startKey, nil, limit)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for i, key := range keys {
+		if endKey != nil && bytes.Compare(key, endKey) >= 0 {
+			keys, values = keys[:i], values[:i]
+			break
+		}
+	}
+	return keys, values, proof, nil
+}
+
 // GetVersionedWithProof gets the value under the key at the specified version
 // if it exists, or returns nil.
 func (tree *MutableTree) GetVersionedWithProof(key []byte, version int64) ([]byte, *RangeProof, error) {
-	if tree.versions[version] {
+	if tree.VersionExists(version) {
 		t, err := tree.GetImmutable(version)
 		if err != nil {
 			return nil, nil, err
@@ -485,7 +495,7 @@ func (tree *MutableTree) GetVersionedWithProof(key []byte, version int64) ([]byt
 func (tree *MutableTree) GetVersionedRangeWithProof(startKey, endKey []byte, limit int, version int64) (
 	keys, values [][]byte, proof *RangeProof, err error) {
 
-	if tree.versions[version] {
+	if tree.VersionExists(version) {
 		t, err := tree.GetImmutable(version)
 		if err != nil {
 			return nil, nil, nil, err
@@ -0,0 +1,40 @@
+package iavl
+
+import (
+	"github.com/tendermint/tendermint/crypto/merkle"
+)
+
+// DefaultProofRuntime returns a merkle.ProofRuntime with the decoders of all
+// the IAVL proof operators registered, along with that of merkle's
+// SimpleValueOp, so that the key paths of a multistore (/store/key) verify.
+func DefaultProofRuntime() *merkle.ProofRuntime {
+	prt := merkle.NewProofRuntime()
+	prt.RegisterOpDecoder(merkle.ProofOpSimpleValue, merkle.SimpleValueOpDecoder)
+	prt.RegisterOpDecoder(ProofOpIAVLValue, IAVLValueOpDecoder)
+	prt.RegisterOpDecoder(ProofOpIAVLAbsence, IAVLAbsenceOpDecoder)
+	prt.RegisterOpDecoder(ProofOpIAVLRange, IAVLRangeOpDecoder)
+	return prt
+}
+
+// KeyPath returns the key path of the given keys, outermost first, as
+// expected by VerifyValue and VerifyAbsence. The keys are hex encoded, and
+// are matched against the raw keys of the proof operators.
+func KeyPath(keys ...[]byte) string {
+	keypath := merkle.KeyPath{}
+	for _, key := range keys {
+		keypath = keypath.AppendKey(key, merkle.KeyEncodingHex)
+	}
+	return keypath.String()
+}
+
+// VerifyValue verifies that proof proves value at keypath under root, using
+// the default proof runtime.
+func VerifyValue(proof *merkle.Proof, root []byte, keypath string, value []byte) error {
+	return DefaultProofRuntime().VerifyValue(proof, root, keypath, value)
+}
+
+// VerifyAbsence verifies that proof proves that there is no value at keypath
+// under root, using the default proof runtime.
+func VerifyAbsence(proof *merkle.Proof, root []byte, keypath string) error {
+	return DefaultProofRuntime().VerifyAbsence(proof, root, keypath)
+}
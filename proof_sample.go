@@ -0,0 +1,206 @@
+package iavl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/tendermint/tendermint/crypto/tmhash"
+	cmn "github.com/tendermint/tendermint/libs/common"
+)
+
+// SampleIndices returns k distinct indices picked uniformly at random from a
+// tree of the given size, using the seed as the source of randomness. The same
+// seed always gives the same indices.
+func SampleIndices(seed []byte, k int, size int64) ([]int64, error) {
+	if k < 0 || int64(k) > size {
+		return nil, cmn.NewError("cannot sample %d entries from %d", k, size)
+	}
+	if k == 0 {
+		return []int64{}, nil
+	}
+	n := uint64(size)
+	// Values at or above limit are rejected, to avoid modulo bias.
+	limit := math.MaxUint64 - math.MaxUint64%n
+
+	indices := make([]int64, 0, k)
+	picked := make(map[int64]bool, k)
+	buf := make([]byte, len(seed)+8)
+	copy(buf, seed)
+	for counter := uint64(0); len(indices) < k; counter++ {
+		binary.BigEndian.PutUint64(buf[len(seed):], counter)
+		v := binary.BigEndian.Uint64(tmhash.Sum(buf))
+		if v >= limit {
+			continue
+		}
+		index := int64(v % n)
+		if picked[index] {
+			continue
+		}
+		picked[index] = true
+		indices = append(indices, index)
+	}
+	return indices, nil
+}
+
+// SampleProof proves the entries at the indices picked by SampleIndices for a
+// seed. It holds a path and a leaf for each sampled entry, in index order. The
+// paths share the inner nodes they have in common: each path after the first
+// starts below the node where it branches off the previous path, at depth
+// Shared[i], and takes the nodes above it from the previous path.
+type SampleProof struct {
+	Shared []int           `json:"shared"`
+	Paths  []PathToLeaf    `json:"paths"`
+	Leaves []proofLeafNode `json:"leaves"`
+}
+
+// String returns a string representation of the proof.
+func (proof *SampleProof) String() string {
+	if proof == nil {
+		return "<nil-SampleProof>"
+	}
+	strs := make([]string, 0, len(proof.Leaves))
+	for i, leaf := range proof.Leaves {
+		strs = append(strs, fmt.Sprintf("Shared: %d\n    %v", proof.Shared[i],
+			pathWithLeaf{Path: proof.Paths[i], Leaf: leaf}.StringIndented("    ")))
+	}
+	return fmt.Sprintf(`SampleProof{
+  Entries:
+    %v
+}`, strings.Join(strs, "\n    "))
+}
+
+// fullPaths returns the whole path of each entry, from the root. The node
+// where a path branches off the previous one is that of the previous path,
+// with the hash of its left child computed from the previous entry.
+func (proof *SampleProof) fullPaths() ([]PathToLeaf, error) {
+	paths := make([]PathToLeaf, 0, len(proof.Paths))
+	for i, path := range proof.Paths {
+		if i == 0 {
+			if proof.Shared[i] != 0 {
+				return nil, cmn.ErrorWrap(ErrInvalidProof, "first entry shares %d nodes", proof.Shared[i])
+			}
+			paths = append(paths, path)
+			continue
+		}
+		prev, shared := paths[i-1], proof.Shared[i]
+		if shared < 0 || shared >= len(prev) || prev[shared].Left != nil {
+			return nil, cmn.ErrorWrap(ErrInvalidProof, "entry %d does not branch off at depth %d", i, shared)
+		}
+		branch := prev[shared]
+		branch.Left = pathWithLeaf{Path: prev[shared+1:], Leaf: proof.Leaves[i-1]}.computeRootHash()
+		branch.Right = nil
+		full := make(PathToLeaf, 0, shared+1+len(path))
+		full = append(append(append(full, prev[:shared]...), branch), path...)
+		paths = append(paths, full)
+	}
+	return paths, nil
+}
+
+// branchDepth returns the depth of the node where the path to a leaf right of
+// that of prev branches off it, which is the number of nodes they share.
+func branchDepth(prev, path PathToLeaf) int {
+	n := 0
+	for n < len(prev) && n < len(path) && bytes.Equal(prev[n].Right, path[n].Right) {
+		n++
+	}
+	return n
+}
+
+// sampleOrder returns the positions in the sample of the indices, sorted by
+// index.
+func sampleOrder(indices []int64) []int {
+	order := make([]int, len(indices))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool {
+		return indices[order[a]] < indices[order[b]]
+	})
+	return order
+}
+
+// Verify checks that keys and values are the k entries sampled with seed from
+// the tree with the given root hash, in sample order.
+func (proof *SampleProof) Verify(root []byte, seed []byte, k int, keys, values [][]byte) error {
+	if proof == nil {
+		return cmn.ErrorWrap(ErrInvalidProof, "proof is nil")
+	}
+	if k == 0 || len(proof.Shared) != k || len(proof.Paths) != k || len(proof.Leaves) != k ||
+		len(keys) != k || len(values) != k {
+		return cmn.ErrorWrap(ErrInvalidProof, "expected %d entries", k)
+	}
+	paths, err := proof.fullPaths()
+	if err != nil {
+		return err
+	}
+	// The size of the tree is that of the root node of the first path.
+	size := int64(1)
+	if len(paths[0]) > 0 {
+		size = paths[0][0].Size
+	}
+	indices, err := SampleIndices(seed, k, size)
+	if err != nil {
+		return cmn.ErrorWrap(ErrInvalidProof, err.Error())
+	}
+
+	for i, j := range sampleOrder(indices) {
+		path, leaf := paths[i], proof.Leaves[i]
+		if err := (pathWithLeaf{Path: path, Leaf: leaf}).verify(root); err != nil {
+			return cmn.ErrorWrap(err, "entry %d", j)
+		}
+		if index := path.Index(); index != indices[j] {
+			return cmn.ErrorWrap(ErrInvalidProof, "entry %d is at index %d, not %d", j, index, indices[j])
+		}
+		if !bytes.Equal(leaf.Key, keys[j]) {
+			return cmn.ErrorWrap(ErrInvalidProof, "entry %d has key %X, not %X", j, leaf.Key, keys[j])
+		}
+		if !bytes.Equal(leaf.ValueHash, tmhash.Sum(values[j])) {
+			return cmn.ErrorWrap(ErrInvalidProof, "entry %d value hash not same", j)
+		}
+	}
+	return nil
+}
+
+// GetSampleWithProof returns the k entries at the indices picked by
+// SampleIndices for the seed, in sample order, along with a combined proof.
+func (t *ImmutableTree) GetSampleWithProof(seed []byte, k int) (keys, values [][]byte, proof *SampleProof, err error) {
+	if k <= 0 {
+		return nil, nil, nil, cmn.NewError("must sample at least one entry")
+	}
+	indices, err := SampleIndices(seed, k, t.Size())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	t.root.hashWithCount() // Ensure that all hashes are calculated.
+
+	keys, values = make([][]byte, k), make([][]byte, k)
+	proof = &SampleProof{
+		Shared: make([]int, 0, k),
+		Paths:  make([]PathToLeaf, 0, k),
+		Leaves: make([]proofLeafNode, 0, k),
+	}
+	prev := PathToLeaf(nil)
+	for _, j := range sampleOrder(indices) {
+		path := PathToLeaf(nil)
+		leaf := t.root.pathToIndex(t, indices[j], &path)
+		shared, nodes := 0, path
+		if prev != nil {
+			shared = branchDepth(prev, path)
+			nodes = path[shared+1:]
+		}
+		proof.Shared = append(proof.Shared, shared)
+		proof.Paths = append(proof.Paths, nodes)
+		proof.Leaves = append(proof.Leaves, proofLeafNode{
+			Key:       leaf.key,
+			ValueHash: tmhash.Sum(leaf.value),
+			Version:   leaf.version,
+		})
+		keys[j], values[j] = leaf.key, leaf.value
+		prev = path
+	}
+	return keys, values, proof, nil
+}
@@ -0,0 +1,123 @@
+package iavl
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/tendermint/tendermint/crypto/tmhash"
+	cmn "github.com/tendermint/tendermint/libs/common"
+)
+
+// SizeProof proves the number of entries in a tree. It holds the root node's
+// hash preimage, which includes the size of the tree. If the root is a leaf,
+// Leaf is set instead of the child hashes.
+type SizeProof struct {
+	Height  int8           `json:"height"`
+	Size    int64          `json:"size"`
+	Version int64          `json:"version"`
+	Left    []byte         `json:"left"`
+	Right   []byte         `json:"right"`
+	Leaf    *proofLeafNode `json:"leaf"`
+}
+
+// String returns a string representation of the proof.
+func (proof *SizeProof) String() string {
+	if proof == nil {
+		return "<nil-SizeProof>"
+	}
+	leaf := "<nil>"
+	if proof.Leaf != nil {
+		leaf = proof.Leaf.stringIndented("  ")
+	}
+	return fmt.Sprintf(`SizeProof{
+  Height:  %v
+  Size:    %v
+  Version: %v
+  Left:    %X
+  Right:   %X
+  Leaf:    %v
+}`, proof.Height, proof.Size, proof.Version, proof.Left, proof.Right, leaf)
+}
+
+// Verify checks that the tree with the given root hash has size entries.
+// An empty root hash is the root of an empty tree.
+func (proof *SizeProof) Verify(root []byte, size int64) error {
+	if proof == nil {
+		return cmn.ErrorWrap(ErrInvalidProof, "proof is nil")
+	}
+	if proof.Size != size {
+		return cmn.ErrorWrap(ErrInvalidProof, "proof is for size %d, not %d", proof.Size, size)
+	}
+	if !bytes.Equal(proof.computeRootHash(), root) {
+		return cmn.ErrorWrap(ErrInvalidRoot, "root hash doesn't match")
+	}
+	return nil
+}
+
+// computeRootHash returns the hash of the root node described by the proof,
+// or nil if the proof is malformed.
+func (proof *SizeProof) computeRootHash() []byte {
+	switch {
+	case proof.Size == 0:
+		if proof.Height != 0 || proof.Leaf != nil || proof.Left != nil || proof.Right != nil {
+			return nil
+		}
+		return []byte{}
+	case proof.Leaf != nil:
+		if proof.Size != 1 || proof.Height != 0 || proof.Leaf.Version != proof.Version {
+			return nil
+		}
+		return proof.Leaf.Hash()
+	default:
+		if proof.Height <= 0 || proof.Size < 2 ||
+			len(proof.Left) != tmhash.Size || len(proof.Right) != tmhash.Size {
+			return nil
+		}
+		pin := proofInnerNode{
+			Height:  proof.Height,
+			Size:    proof.Size,
+			Version: proof.Version,
+			Right:   proof.Right,
+		}
+		return pin.Hash(proof.Left)
+	}
+}
+
+// GetSizeWithProof returns the number of entries in the tree, with a proof
+// that the tree's root hash commits to it.
+func (t *ImmutableTree) GetSizeWithProof() (int64, *SizeProof, error) {
+	if t.root == nil {
+		return 0, &SizeProof{}, nil
+	}
+	t.root.hashWithCount() // Ensure that all hashes are calculated.
+
+	proof := &SizeProof{
+		Height:  t.root.height,
+		Size:    t.root.size,
+		Version: t.root.version,
+	}
+	if t.root.isLeaf() {
+		proof.Leaf = &proofLeafNode{
+			Key:       t.root.key,
+			ValueHash: tmhash.Sum(t.root.value),
+			Version:   t.root.version,
+		}
+	} else {
+		proof.Left = t.root.getLeftNode(t).hash
+		proof.Right = t.root.getRightNode(t).hash
+	}
+	return proof.Size, proof, nil
+}
+
+// GetVersionedSizeWithProof is like GetSizeWithProof, for the specified
+// version.
+func (tree *MutableTree) GetVersionedSizeWithProof(version int64) (int64, *SizeProof, error) {
+	if tree.VersionExists(version) {
+		t, err := tree.GetImmutable(version)
+		if err != nil {
+			return 0, nil, err
+		}
+		return t.GetSizeWithProof()
+	}
+	return 0, nil, cmn.ErrorWrap(ErrVersionDoesNotExist, "")
+}
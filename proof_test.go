@@ -2,14 +2,22 @@ package iavl
 
 import (
 	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	"github.com/tendermint/go-amino"
+	"github.com/tendermint/tendermint/crypto/merkle"
+	cmn "github.com/tendermint/tendermint/libs/common"
 	"github.com/tendermint/tendermint/libs/db"
 	"github.com/tendermint/tendermint/libs/test"
+
+	"github.com/tendermint/iavl/verifier"
 )
 
 func TestTreeGetWithProof(t *testing.T) {
@@ -46,6 +54,648 @@ func TestTreeGetWithProof(t *testing.T) {
 	require.NoError(err, "%+v", err)
 }
 
+func TestTreeGetByIndexWithProof(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	require := require.New(t)
+	_, _, _, err := tree.GetByIndexWithProof(0)
+	require.Error(err, "empty tree")
+
+	for i := 0; i < 100; i++ {
+		tree.Set([]byte{byte(i * 2)}, []byte(random.Str(8)))
+	}
+	root := tree.WorkingHash()
+
+	for i := int64(0); i < tree.Size(); i++ {
+		key, val, proof, err := tree.GetByIndexWithProof(i)
+		require.NoError(err)
+		require.Equal([]byte{byte(i * 2)}, key)
+		require.NoError(proof.Verify(root))
+		require.NoError(proof.VerifyItemAt(i, key, val))
+		require.Error(proof.VerifyItemAt(i+1, key, val))
+		require.Error(proof.VerifyItemAt(i, key, []byte("wrong")))
+	}
+
+	_, _, _, err = tree.GetByIndexWithProof(-1)
+	require.Error(err)
+	_, _, _, err = tree.GetByIndexWithProof(tree.Size())
+	require.Error(err)
+
+	// Range proofs bind the index of all their leaves.
+	keys, values, proof, err := tree.GetRangeWithProof([]byte{21}, []byte{41}, 0)
+	require.NoError(err)
+	require.NoError(proof.Verify(root))
+	for i, key := range keys {
+		require.NoError(proof.VerifyItemAt(int64(11+i), key, values[i]))
+	}
+}
+
+func TestTreeGetSizeWithProof(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	require := require.New(t)
+
+	size, proof, err := tree.GetSizeWithProof()
+	require.NoError(err)
+	require.EqualValues(0, size)
+	require.NoError(proof.Verify(tree.WorkingHash(), 0))
+	require.Error(proof.Verify(tree.WorkingHash(), 1))
+
+	for i := 0; i < 50; i++ {
+		tree.Set([]byte{byte(i)}, []byte(random.Str(8)))
+		root := tree.WorkingHash()
+		size, proof, err := tree.GetSizeWithProof()
+		require.NoError(err)
+		require.EqualValues(i+1, size)
+		require.NoError(proof.Verify(root, size))
+		require.Error(proof.Verify(root, size+1))
+
+		// The size can't be changed without changing the root hash.
+		proof.Size++
+		require.Error(proof.Verify(root, size+1))
+	}
+
+	_, _, err = tree.SaveVersion()
+	require.NoError(err)
+	tree.Set([]byte("new"), []byte("new"))
+	size, proof, err = tree.GetVersionedSizeWithProof(1)
+	require.NoError(err)
+	require.NoError(proof.Verify(tree.Hash(), 50))
+	_, _, err = tree.GetVersionedSizeWithProof(2)
+	require.Error(err)
+}
+
+func TestTreeGetSampleWithProof(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	require := require.New(t)
+	seed := []byte("seed")
+
+	_, _, _, err := tree.GetSampleWithProof(seed, 1)
+	require.Error(err, "empty tree")
+
+	for _, size := range []int{1, 2, 10, 300} {
+		for tree.Size() < int64(size) {
+			tree.Set([]byte(random.Str(8)), []byte(random.Str(8)))
+		}
+		root := tree.WorkingHash()
+
+		k := 5
+		if k > size {
+			k = size
+		}
+		keys, values, proof, err := tree.GetSampleWithProof(seed, k)
+		require.NoError(err)
+		require.Len(keys, k)
+		require.NoError(proof.Verify(root, seed, k, keys, values))
+
+		// The sample is reproducible, and distinct.
+		indices, err := SampleIndices(seed, k, int64(size))
+		require.NoError(err)
+		seen := map[int64]bool{}
+		for i, index := range indices {
+			require.Equal(index, tree.IndexOf(keys[i]))
+			require.False(seen[index])
+			seen[index] = true
+		}
+
+		// The paths share the inner nodes they have in common.
+		paths, err := proof.fullPaths()
+		require.NoError(err)
+		stored, full := 0, 0
+		for i := range paths {
+			stored += len(proof.Paths[i])
+			full += len(paths[i])
+		}
+		if k > 1 {
+			require.True(stored < full, "%d of %d inner nodes", stored, full)
+			proof.Shared[1]++
+			require.Error(proof.Verify(root, seed, k, keys, values))
+			proof.Shared[1]--
+		}
+
+		if size > k {
+			require.Error(proof.Verify(root, []byte("other"), k, keys, values))
+		}
+		require.Error(proof.Verify(root, seed, k-1, keys[1:], values[1:]))
+		values[0] = []byte("wrong")
+		require.Error(proof.Verify(root, seed, k, keys, values))
+	}
+
+	_, _, _, err = tree.GetSampleWithProof(seed, 301)
+	require.Error(err)
+}
+
+func TestTreeGetUnchangedWithProof(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	require := require.New(t)
+
+	for i := 0; i < 20; i++ {
+		tree.Set([]byte{byte(i * 2)}, []byte{byte(i)})
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(err)
+	tree.Set([]byte{2}, []byte("changed"))
+	tree.Set([]byte{4}, []byte{2}) // Same value.
+	tree.Set([]byte{5}, []byte("added"))
+	_, _, err = tree.SaveVersion()
+	require.NoError(err)
+	tree.Set([]byte{8}, []byte("changed"))
+	_, _, err = tree.SaveVersion()
+	require.NoError(err)
+
+	root1, root2, root3 := tree.ndb.getRoot(1), tree.ndb.getRoot(2), tree.ndb.getRoot(3)
+
+	value, proof, err := tree.GetUnchangedWithProof([]byte{6}, 1, 3)
+	require.NoError(err)
+	require.Equal([]byte{3}, value)
+	require.NoError(proof.Verify([]byte{6}, value, 1, root1, root3))
+	require.Error(proof.Verify([]byte{6}, []byte{4}, 1, root1, root3))
+	require.Error(proof.Verify([]byte{6}, value, 1, root1, root2))
+	require.Error(proof.Verify([]byte{6}, value, 0, root1, root3))
+
+	// Absent keys.
+	value, proof, err = tree.GetUnchangedWithProof([]byte{7}, 1, 3)
+	require.NoError(err)
+	require.Nil(value)
+	require.NoError(proof.Verify([]byte{7}, nil, 1, root1, root3))
+	require.Error(proof.Verify([]byte{7}, []byte{1}, 1, root1, root3))
+
+	_, _, err = tree.GetUnchangedWithProof([]byte{2}, 1, 2)
+	require.Error(err, "value changed")
+	_, _, err = tree.GetUnchangedWithProof([]byte{4}, 1, 2)
+	require.Error(err, "written with the same value")
+	_, _, err = tree.GetUnchangedWithProof([]byte{5}, 1, 2)
+	require.Error(err, "key added")
+	_, _, err = tree.GetUnchangedWithProof([]byte{8}, 1, 3)
+	require.Error(err, "value changed")
+	_, _, err = tree.GetUnchangedWithProof([]byte{8}, 3, 1)
+	require.Error(err, "versions out of order")
+
+	// A proof for a rewritten key can't be passed off as unchanged.
+	_, before, err := tree.GetVersionedWithProof([]byte{4}, 1)
+	require.NoError(err)
+	_, after, err := tree.GetVersionedWithProof([]byte{4}, 2)
+	require.NoError(err)
+	proof = &UnchangedProof{Before: before, After: after}
+	require.Error(proof.Verify([]byte{4}, []byte{2}, 1, root1, root2))
+}
+
+func TestTreeGetRangeWithCompleteProof(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	require := require.New(t)
+
+	// Keys which cpIncr would skip over are included too.
+	for _, key := range [][]byte{{0x11}, {0x11, 0x00}, {0x32}, {0x50}, {0x50, 0x01}, {0x72}, {0x99}} {
+		tree.Set(key, key)
+	}
+	root := tree.WorkingHash()
+
+	cases := []struct {
+		start, end []byte
+		count      int
+	}{
+		{nil, nil, 7},
+		{[]byte{0x11}, []byte{0x12}, 2},
+		{[]byte{0x12}, []byte{0x51}, 3},
+		{[]byte{0x50}, nil, 4},
+		{nil, []byte{0x11}, 0},
+		{[]byte{0x99}, nil, 1},
+		{[]byte{0xa0}, nil, 0},
+		{[]byte{0x33}, []byte{0x50}, 0},
+	}
+	for i, c := range cases {
+		keys, values, proof, err := tree.GetRangeWithCompleteProof(c.start, c.end)
+		require.NoError(err)
+		require.Len(keys, c.count, "case %d", i)
+
+		op := NewIAVLRangeOp(c.start, c.end, proof)
+		decoded, err := IAVLRangeOpDecoder(op.ProofOp())
+		require.NoError(err)
+		args := [][]byte{}
+		for j := range keys {
+			args = append(args, keys[j], values[j])
+		}
+		out, err := decoded.Run(args)
+		require.NoError(err, "case %d", i)
+		require.Equal([][]byte{root}, out)
+
+		// Leaving out or adding a pair fails.
+		if len(keys) > 0 {
+			_, err = decoded.Run(args[2:])
+			require.Error(err, "case %d", i)
+		}
+		_, err = decoded.Run(append(args, []byte{0x60}, []byte{0x60}))
+		require.Error(err, "case %d", i)
+	}
+
+	// Proofs which don't reach past the range are rejected.
+	keys, values, proof, err := tree.GetRangeWithProof([]byte{0x11}, []byte{0x12}, 0)
+	require.NoError(err)
+	require.NoError(proof.Verify(root))
+	require.Error(proof.VerifyRange([]byte{0x11}, []byte{0x12}, keys, values))
+
+	_, _, _, err = tree.GetRangeWithCompleteProof([]byte{0x50}, []byte{0x50})
+	require.Error(err)
+}
+
+func TestDefaultProofRuntime(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	require := require.New(t)
+	for _, key := range []string{"a", "b/c", "d e", "\x00\xff"} {
+		tree.Set([]byte(key), []byte("v"+key))
+	}
+	root := tree.WorkingHash()
+
+	for _, key := range [][]byte{[]byte("b/c"), []byte("d e"), {0x00, 0xff}} {
+		value, rangeProof, err := tree.GetWithProof(key)
+		require.NoError(err)
+		proof := &merkle.Proof{Ops: []merkle.ProofOp{NewIAVLValueOp(key, rangeProof).ProofOp()}}
+		require.NoError(VerifyValue(proof, root, KeyPath(key), value))
+		require.Error(VerifyValue(proof, root, KeyPath(key), []byte("wrong")))
+		require.Error(VerifyValue(proof, root, KeyPath([]byte("other")), value))
+		require.Error(VerifyAbsence(proof, root, KeyPath(key)))
+	}
+
+	key := []byte("c")
+	_, rangeProof, err := tree.GetWithProof(key)
+	require.NoError(err)
+	proof := &merkle.Proof{Ops: []merkle.ProofOp{NewIAVLAbsenceOp(key, rangeProof).ProofOp()}}
+	require.NoError(VerifyAbsence(proof, root, KeyPath(key)))
+	require.Error(VerifyAbsence(proof, tree.Hash(), KeyPath(key)))
+
+	keys, values, rangeProof, err := tree.GetRangeWithCompleteProof([]byte("b"), []byte("e"))
+	require.NoError(err)
+	proof = &merkle.Proof{Ops: []merkle.ProofOp{NewIAVLRangeOp([]byte("b"), []byte("e"), rangeProof).ProofOp()}}
+	args := [][]byte{keys[0], values[0], keys[1], values[1]}
+	require.NoError(DefaultProofRuntime().Verify(proof, root, KeyPath([]byte("b")), args))
+
+	// The tree as a store of a multistore, proven by a simple map of the
+	// store roots.
+	storesRoot, storeProofs, _ := merkle.SimpleProofsFromMap(map[string][]byte{
+		"other": []byte("root"),
+		"store": root,
+	})
+	key = []byte("b/c")
+	value, rangeProof, err := tree.GetWithProof(key)
+	require.NoError(err)
+	proof = &merkle.Proof{Ops: []merkle.ProofOp{
+		NewIAVLValueOp(key, rangeProof).ProofOp(),
+		merkle.NewSimpleValueOp([]byte("store"), storeProofs["store"]).ProofOp(),
+	}}
+	require.NoError(VerifyValue(proof, storesRoot, KeyPath([]byte("store"), key), value))
+	require.Error(VerifyValue(proof, storesRoot, KeyPath([]byte("other"), key), value))
+	require.Error(VerifyValue(proof, root, KeyPath([]byte("store"), key), value))
+}
+
+func TestTreeGetCommitmentProof(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	require := require.New(t)
+
+	keys := [][]byte{}
+	for i := 0; i < 50; i++ {
+		key := []byte{byte(i * 4), 0x01}
+		keys = append(keys, key)
+		tree.Set(key, []byte{byte(i)})
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(err)
+	tree.Set(keys[10], []byte("updated")) // Leaves of different versions.
+	root := tree.WorkingHash()
+
+	for _, key := range keys {
+		_, value := tree.Get(key)
+		proof, err := tree.GetCommitmentProof(key)
+		require.NoError(err)
+		require.Nil(proof.Nonexist)
+		require.NoError(proof.Exist.Verify(root, key, value))
+		require.Error(proof.Exist.Verify(root, key, []byte("wrong")))
+		require.Error(proof.Nonexist.Verify(root, key))
+	}
+
+	// Before the first key, between keys and after the last key.
+	for _, key := range [][]byte{{0x00}, {0x08}, {0x08, 0x02}, {0xf0}} {
+		proof, err := tree.GetCommitmentProof(key)
+		require.NoError(err)
+		require.Nil(proof.Exist)
+		require.NoError(proof.Nonexist.Verify(root, key), "key %X", key)
+		require.Error(proof.Nonexist.Verify(root, []byte{0x40, 0x01}))
+	}
+
+	// The protobuf encoding round trips.
+	for _, key := range [][]byte{keys[10], {0x08, 0x02}, {0xf0}} {
+		proof, err := tree.GetCommitmentProof(key)
+		require.NoError(err)
+		bz, err := proof.Marshal()
+		require.NoError(err)
+		decoded := new(CommitmentProof)
+		require.NoError(decoded.Unmarshal(bz))
+		require.Equal(proof, decoded)
+		require.Error(decoded.Unmarshal(bz[:len(bz)-1]))
+	}
+	proof := &CommitmentProof{Exist: &ExistenceProof{
+		Key:   []byte{0x01},
+		Value: []byte{0x02},
+		Leaf: &LeafOp{
+			Hash:         HashOpSHA256,
+			PrehashValue: HashOpSHA256,
+			Length:       LengthOpVarProto,
+			Prefix:       []byte{0x00, 0x02, 0x02},
+		},
+		Path: []*InnerOp{{Hash: HashOpSHA256, Prefix: []byte{0x02}, Suffix: []byte{0x03}}},
+	}}
+	bz, err := proof.Marshal()
+	require.NoError(err)
+	require.Equal("0A1D0A0101120102"+"1A0B0801180120012A03000202"+"220808011201021A0103", cmn.HexBytes(bz).String())
+	_, err = (&CommitmentProof{}).Marshal()
+	require.Error(err)
+
+	// Neighbors which aren't adjacent are rejected.
+	left, err := tree.GetCommitmentProof(keys[3])
+	require.NoError(err)
+	right, err := tree.GetCommitmentProof(keys[5])
+	require.NoError(err)
+	nonexist := &NonExistenceProof{Key: []byte{0x0d}, Left: left.Exist, Right: right.Exist}
+	require.Error(nonexist.Verify(root, []byte{0x0d}))
+	nonexist = &NonExistenceProof{Key: []byte{0x00}, Right: right.Exist}
+	require.Error(nonexist.Verify(root, []byte{0x00}))
+
+	// Proofs of the non-first keys of a range proof are converted too.
+	rangeKeys, rangeValues, rangeProof, err := tree.GetRangeWithProof(keys[7], nil, 20)
+	require.NoError(err)
+	for i, key := range rangeKeys {
+		exist, err := ConvertExistenceProof(rangeProof, key, rangeValues[i])
+		require.NoError(err)
+		require.NoError(exist.Verify(root, key, rangeValues[i]))
+	}
+	_, err = ConvertExistenceProof(rangeProof, keys[0], []byte{0})
+	require.Error(err)
+}
+
+func TestVerifierPackage(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	require := require.New(t)
+	for _, ikey := range []byte{0x11, 0x32, 0x50, 0x72, 0x99} {
+		tree.Set([]byte{ikey}, []byte{ikey})
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(err)
+	tree.Set([]byte{0x32}, []byte("updated"))
+	root := tree.WorkingHash()
+
+	// Proofs encoded to JSON are verified by the verifier package.
+	decode := func(proof *RangeProof) *verifier.RangeProof {
+		bz, err := json.Marshal(proof)
+		require.NoError(err)
+		vproof := new(verifier.RangeProof)
+		require.NoError(json.Unmarshal(bz, vproof))
+		return vproof
+	}
+
+	_, _, proof, err := tree.GetRangeWithProof(nil, nil, 0)
+	require.NoError(err)
+	vproof := decode(proof)
+	require.Error(vproof.VerifyItem([]byte{0x11}, []byte{0x11}))
+	require.NoError(vproof.Verify(root))
+	require.NoError(vproof.VerifyItem([]byte{0x32}, []byte("updated")))
+	require.Error(vproof.VerifyItem([]byte{0x32}, []byte{0x32}))
+	require.NoError(vproof.VerifyAbsence([]byte{0x40}))
+	require.NoError(vproof.VerifyAbsence([]byte{0xa0}))
+	require.Error(vproof.VerifyAbsence([]byte{0x50}))
+	require.Error(vproof.Verify([]byte("wrong root")))
+
+	value, proof, err := tree.GetWithProof([]byte{0x40})
+	require.NoError(err)
+	require.Nil(value)
+	vproof = decode(proof)
+	require.NoError(vproof.Verify(root))
+	require.NoError(vproof.VerifyAbsence([]byte{0x40}))
+
+	// Tampered proofs are rejected.
+	vproof.Leaves[0].ValueHash[0] ^= 0xff
+	require.Error(vproof.Verify(root))
+
+	// Errors of the verifier package are returned with the errors of this one
+	// as their cause.
+	err = proof.Verify([]byte("wrong root"))
+	require.Equal(ErrInvalidRoot, err.(cmn.Error).Data(), err.Error())
+	require.NoError(proof.Verify(root))
+	err = proof.VerifyItem([]byte{0x50}, []byte("wrong"))
+	require.Equal(ErrInvalidProof, err.(cmn.Error).Data(), err.Error())
+	err = proof.VerifyAbsence([]byte{0x50})
+	require.Equal(ErrInvalidProof, err.(cmn.Error).Data(), err.Error())
+
+	// The fixtures of the verifier package's tests are proofs of this tree,
+	// which verify with this package too.
+	for name, check := range map[string]func(*RangeProof) error{
+		"range_proof.json": func(proof *RangeProof) error {
+			return proof.VerifyItem([]byte{0x32}, []byte("updated"))
+		},
+		"absence_proof.json": func(proof *RangeProof) error {
+			return proof.VerifyAbsence([]byte{0x40})
+		},
+	} {
+		bz, err := ioutil.ReadFile(filepath.Join("verifier", "testdata", name))
+		require.NoError(err)
+		var fixture struct {
+			Root  cmn.HexBytes `json:"root"`
+			Proof *RangeProof  `json:"proof"`
+		}
+		require.NoError(json.Unmarshal(bz, &fixture), name)
+		require.NoError(fixture.Proof.Verify(fixture.Root), name)
+		require.NoError(check(fixture.Proof), name)
+		require.Error(fixture.Proof.Verify(root[:len(root)-1]), name)
+	}
+}
+
+func TestRangeProofCompact(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	require := require.New(t)
+
+	for i := 0; i < 1000; i++ {
+		key := randBytes(8)
+		tree.Set(key, key)
+		if i%100 == 0 {
+			_, _, err := tree.SaveVersion()
+			require.NoError(err)
+		}
+	}
+	root := tree.WorkingHash()
+	keys := [][]byte{}
+	tree.Iterate(func(key, _ []byte) bool {
+		keys = append(keys, key)
+		return false
+	})
+
+	var proofs []*RangeProof
+	for _, limit := range []int{1, 2, 10, 100, 0} {
+		_, _, proof, err := tree.GetRangeWithProof(keys[len(keys)/3], nil, limit)
+		require.NoError(err)
+		proofs = append(proofs, proof)
+	}
+	_, proof, err := tree.GetWithProof([]byte("absent"))
+	require.NoError(err)
+	proofs = append(proofs, proof)
+
+	for i, proof := range proofs {
+		bz, err := proof.MarshalCompact()
+		require.NoError(err)
+		aminoSize := len(cdc.MustMarshalBinaryLengthPrefixed(proof))
+		require.True(len(bz) < aminoSize, "proof %d", i)
+		if len(proof.Leaves) >= 100 {
+			// About half the size, see PROOF_SPEC.md.
+			require.True(float64(len(bz)) < 0.55*float64(aminoSize), "proof %d: %d of %d bytes", i, len(bz), aminoSize)
+		}
+
+		decoded, err := UnmarshalCompactRangeProof(bz)
+		require.NoError(err)
+		require.Equal(proof.LeftPath, decoded.LeftPath)
+		require.Equal(proof.InnerNodes, decoded.InnerNodes)
+		require.Equal(proof.Leaves, decoded.Leaves)
+		require.NoError(decoded.Verify(root))
+
+		// Truncated or extended input is rejected.
+		_, err = UnmarshalCompactRangeProof(bz[:len(bz)-1])
+		require.Error(err)
+		_, err = UnmarshalCompactRangeProof(append(bz, 0))
+		require.Error(err)
+
+		// A changed value hash changes the derived hashes.
+		tampered := append([]byte{}, bz...)
+		tampered[len(tampered)-1] ^= 0xff
+		if decoded, err := UnmarshalCompactRangeProof(tampered); err == nil {
+			require.Error(decoded.Verify(root))
+		}
+	}
+
+	// A single leaf tree has an empty left path.
+	tree = NewMutableTree(db.NewMemDB(), 0)
+	tree.Set([]byte{1}, []byte{1})
+	_, proof, err = tree.GetWithProof([]byte{1})
+	require.NoError(err)
+	bz, err := proof.MarshalCompact()
+	require.NoError(err)
+	decoded, err := UnmarshalCompactRangeProof(bz)
+	require.NoError(err)
+	require.NoError(decoded.Verify(tree.WorkingHash()))
+
+	_, err = UnmarshalCompactRangeProof(nil)
+	require.Error(err)
+}
+
+func TestProofJSON(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	require := require.New(t)
+	for _, ikey := range []byte{0x11, 0x32, 0x50, 0x72, 0x99} {
+		tree.Set([]byte{ikey}, []byte{ikey})
+	}
+	root := tree.WorkingHash()
+
+	value, valueProof, err := tree.GetWithProof([]byte{0x32})
+	require.NoError(err)
+	_, absenceProof, err := tree.GetWithProof([]byte{0x40})
+	require.NoError(err)
+	keys, values, rangeProof, err := tree.GetRangeWithCompleteProof([]byte{0x30}, nil)
+	require.NoError(err)
+
+	proofs := []interface{}{
+		valueProof,
+		NewIAVLValueOp([]byte{0x32}, valueProof),
+		NewIAVLAbsenceOp([]byte{0x40}, absenceProof),
+		NewIAVLAbsenceOp([]byte{0x40}, nil),
+		NewIAVLRangeOp([]byte{0x30}, nil, rangeProof),
+		NewIAVLRangeOp([]byte{0x30}, []byte{0xa0}, rangeProof),
+	}
+	for i, proof := range proofs {
+		bz, err := MarshalProofJSON(proof)
+		require.NoError(err)
+		decoded, err := UnmarshalProofJSON(bz)
+		require.NoError(err, "proof %d: %s", i, bz)
+		require.Equal(proof, decoded, "proof %d", i)
+	}
+
+	// Decoded proofs verify.
+	bz, err := MarshalProofJSON(NewIAVLValueOp([]byte{0x32}, valueProof))
+	require.NoError(err)
+	decoded, err := UnmarshalProofJSON(bz)
+	require.NoError(err)
+	out, err := decoded.(IAVLValueOp).Run([][]byte{value})
+	require.NoError(err)
+	require.Equal([][]byte{root}, out)
+
+	bz, err = MarshalProofJSON(NewIAVLRangeOp([]byte{0x30}, nil, rangeProof))
+	require.NoError(err)
+	decoded, err = UnmarshalProofJSON(bz)
+	require.NoError(err)
+	args := [][]byte{}
+	for i := range keys {
+		args = append(args, keys[i], values[i])
+	}
+	out, err = decoded.(IAVLRangeOp).Run(args)
+	require.NoError(err)
+	require.Equal([][]byte{root}, out)
+
+	// The verifier package decodes and verifies them too.
+	bz, err = MarshalProofJSON(NewIAVLValueOp([]byte{0x32}, valueProof))
+	require.NoError(err)
+	vdecoded, err := verifier.UnmarshalProofJSON(bz)
+	require.NoError(err)
+	require.Equal(ProofOpIAVLValue, vdecoded.Type)
+	require.Equal([]byte{0x32}, vdecoded.Key)
+	require.Nil(vdecoded.End)
+	require.NoError(vdecoded.Proof.Verify(root))
+	require.NoError(vdecoded.Proof.VerifyItem([]byte{0x32}, value))
+	require.Error(vdecoded.Proof.VerifyItem([]byte{0x32}, []byte("wrong")))
+
+	bz, err = MarshalProofJSON(NewIAVLRangeOp([]byte{0x30}, []byte{0xa0}, rangeProof))
+	require.NoError(err)
+	vdecoded, err = verifier.UnmarshalProofJSON(bz)
+	require.NoError(err)
+	require.Equal([]byte{0xa0}, vdecoded.End)
+	require.NoError(vdecoded.Proof.Verify(root))
+	for i := range keys {
+		require.NoError(vdecoded.Proof.VerifyItem(keys[i], values[i]))
+	}
+
+	bz, err = MarshalProofJSON(NewIAVLAbsenceOp([]byte{0x40}, nil))
+	require.NoError(err)
+	vdecoded, err = verifier.UnmarshalProofJSON(bz)
+	require.NoError(err)
+	require.Nil(vdecoded.Proof)
+
+	// Non-canonical or invalid encodings are rejected.
+	bz, err = MarshalProofJSON(valueProof)
+	require.NoError(err)
+	var hash string
+	{
+		var pj proofJSON
+		require.NoError(json.Unmarshal(bz, &pj))
+		hash = pj.Proof.Leaves[0].ValueHash.String()
+	}
+	invalid := []string{
+		strings.Replace(string(bz), `"version":1`, `"version":2`, 1),
+		strings.Replace(string(bz), `{"version":1,`, `{"version":1, `, 1),
+		strings.Replace(string(bz), `{"version":1,`, `{"version":1,"extra":0,`, 1),
+		strings.Replace(string(bz), `{"version":1,`, `{"version":1,"key":"32",`, 1),
+		strings.Replace(string(bz), hash, strings.ToLower(hash), 1),
+		strings.Replace(string(bz), hash, hash[2:], 1),
+		strings.Replace(string(bz), `"leaves":[`, `"leaves":[{"key":"00","value_hash":"`+hash+`","version":"1"},`, 1),
+		strings.Replace(string(bz), `"version":"1"`, `"version":1`, 1),
+		strings.Replace(string(bz), `"version":"1"`, `"version":"01"`, 1),
+		string(bz) + " ",
+	}
+	for i, s := range invalid {
+		require.NotEqual(string(bz), s, "case %d", i)
+		_, err := UnmarshalProofJSON([]byte(s))
+		require.Error(err, "case %d: %s", i, s)
+	}
+	_, err = verifier.UnmarshalProofJSON([]byte(invalid[0]))
+	require.Error(err)
+	vdecoded, err = verifier.UnmarshalProofJSON(bz)
+	require.NoError(err)
+	require.Equal(ProofJSONTypeRange, vdecoded.Type)
+	require.NoError(vdecoded.Proof.Verify(root))
+	_, err = MarshalProofJSON("not a proof")
+	require.Error(err)
+}
+
 func TestTreeKeyExistsProof(t *testing.T) {
 	tree := NewMutableTree(db.NewMemDB(), 0)
 	root := tree.WorkingHash()
@@ -202,6 +852,30 @@ func TestTreeKeyInRangeProofs(t *testing.T) {
 	}
 }
 
+func TestTreeRangeProofKeysExtendingLeft(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	require := require.New(t)
+	keys := [][]byte{{0x01}, {0x01, 0x00}, {0x01, 0x00, 0x00}, {0x01, 0x01}, {0x02}}
+	for _, key := range keys {
+		tree.Set(key, key)
+	}
+	root := tree.WorkingHash()
+
+	// The keys which extend the left key sort between it and cpIncr of it,
+	// and must not be skipped.
+	for _, start := range [][]byte{nil, {0x01}, {0x00, 0xff}} {
+		rkeys, values, proof, err := tree.GetRangeWithProof(start, nil, 0)
+		require.NoError(err)
+		require.Equal(keys, rkeys)
+		require.Equal(keys, values)
+		require.Equal(keys, proof.Keys())
+		require.NoError(proof.Verify(root))
+		for _, key := range keys {
+			require.NoError(proof.VerifyItem(key, key))
+		}
+	}
+}
+
 func verifyProof(t *testing.T, proof *RangeProof, root []byte) {
 	// Proof must verify.
 	require.NoError(t, proof.Verify(root))
@@ -243,3 +917,72 @@ func flatten(bzz [][]byte) (res []byte) {
 	}
 	return res
 }
+
+func TestMergeRangeProofs(t *testing.T) {
+	require := require.New(t)
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	for i := 0; i < 300; i++ {
+		tree.Set(i2b(i), []byte{byte(i)})
+	}
+	root, _, err := tree.SaveVersion()
+	require.NoError(err)
+
+	requireSameProof := func(expected, proof *RangeProof) {
+		require.Equal(expected.LeftPath, proof.LeftPath)
+		require.Equal(expected.InnerNodes, proof.InnerNodes)
+		require.Equal(expected.Leaves, proof.Leaves)
+	}
+
+	// Overlapping proofs, in either order.
+	_, _, a, err := tree.GetRangeWithCompleteProof(i2b(10), i2b(50))
+	require.NoError(err)
+	_, _, b, err := tree.GetRangeWithCompleteProof(i2b(45), i2b(90))
+	require.NoError(err)
+	keys, values, expected, err := tree.GetRangeWithCompleteProof(i2b(10), i2b(90))
+	require.NoError(err)
+	for _, pair := range [][2]*RangeProof{{a, b}, {b, a}, {expected, a}} {
+		merged, err := MergeRangeProofs(pair[0], pair[1])
+		require.NoError(err)
+		requireSameProof(expected, merged)
+		require.NoError(merged.Verify(root))
+		require.NoError(merged.VerifyRange(i2b(10), i2b(90), keys, values))
+	}
+
+	// Adjacent and disjoint proofs.
+	_, _, c, err := tree.GetByIndexWithProof(150)
+	require.NoError(err)
+	_, _, d, err := tree.GetByIndexWithProof(151)
+	require.NoError(err)
+	_, _, e, err := tree.GetByIndexWithProof(153)
+	require.NoError(err)
+	merged, err := MergeRangeProofs(d, c)
+	require.NoError(err)
+	require.NoError(merged.Verify(root))
+	require.Equal(int64(150), merged.LeftIndex())
+	require.Len(merged.Leaves, 2)
+	_, err = MergeRangeProofs(c, e)
+	require.Error(err)
+
+	// Proofs of other trees.
+	tree.Set(i2b(1000), []byte{1})
+	_, _, other, err := tree.ImmutableTree.GetRangeWithCompleteProof(i2b(40), i2b(60))
+	require.NoError(err)
+	_, err = MergeRangeProofs(a, other)
+	require.Error(err)
+
+	// Sub-ranges, including ranges starting and ending between keys.
+	for _, r := range [][2][]byte{{i2b(10), i2b(90)}, {i2b(20), i2b(30)}, {i2b(20), append(i2b(30), 1)}, {append(i2b(20), 1), i2b(21)}} {
+		sub, err := expected.SubRangeProof(r[0], r[1])
+		require.NoError(err)
+		keys, values, _, err := tree.lastSaved.GetRangeWithCompleteProof(r[0], r[1])
+		require.NoError(err)
+		require.NoError(sub.Verify(root))
+		require.NoError(sub.VerifyRange(r[0], r[1], keys, values))
+	}
+	_, err = expected.SubRangeProof(i2b(5), i2b(30))
+	requireNotAvailable(t, err)
+	_, err = expected.SubRangeProof(i2b(30), nil)
+	requireNotAvailable(t, err)
+	_, err = expected.SubRangeProof(i2b(30), i2b(20))
+	require.Error(err)
+}
@@ -0,0 +1,106 @@
+package iavl
+
+import (
+	"bytes"
+	"fmt"
+
+	cmn "github.com/tendermint/tendermint/libs/common"
+)
+
+// UnchangedProof proves that a key has the same value in two versions of a
+// tree. It holds a proof of the key against the root of each version.
+//
+// If the key exists, the leaf in the later version must have been written no
+// later than the earlier version, which shows the key wasn't modified in
+// between. If the key doesn't exist, the proof only shows that it is absent
+// from both versions.
+type UnchangedProof struct {
+	Before *RangeProof `json:"before"`
+	After  *RangeProof `json:"after"`
+}
+
+// String returns a string representation of the proof.
+func (proof *UnchangedProof) String() string {
+	if proof == nil {
+		return "<nil-UnchangedProof>"
+	}
+	return fmt.Sprintf(`UnchangedProof{
+  Before: %v
+  After:  %v
+}`, proof.Before.StringIndented("  "), proof.After.StringIndented("  "))
+}
+
+// Verify checks that key has value, or is absent if value is nil, in both the
+// version with root hash rootBefore, which is the given version, and the
+// version with root hash rootAfter.
+func (proof *UnchangedProof) Verify(key, value []byte, version int64, rootBefore, rootAfter []byte) error {
+	if proof == nil || proof.Before == nil || proof.After == nil {
+		return cmn.ErrorWrap(ErrInvalidProof, "proof is nil")
+	}
+	if err := proof.Before.Verify(rootBefore); err != nil {
+		return cmn.ErrorWrap(err, "verifying proof before")
+	}
+	if err := proof.After.Verify(rootAfter); err != nil {
+		return cmn.ErrorWrap(err, "verifying proof after")
+	}
+
+	if value == nil {
+		if err := proof.Before.VerifyAbsence(key); err != nil {
+			return cmn.ErrorWrap(err, "verifying absence before")
+		}
+		if err := proof.After.VerifyAbsence(key); err != nil {
+			return cmn.ErrorWrap(err, "verifying absence after")
+		}
+		return nil
+	}
+
+	if err := proof.Before.VerifyItem(key, value); err != nil {
+		return cmn.ErrorWrap(err, "verifying item before")
+	}
+	if err := proof.After.VerifyItem(key, value); err != nil {
+		return cmn.ErrorWrap(err, "verifying item after")
+	}
+	before, after := proof.Before.leaf(key), proof.After.leaf(key)
+	if after.Version > version || after.Version != before.Version {
+		return cmn.ErrorWrap(ErrInvalidProof, "key was written at version %d, after version %d",
+			after.Version, version)
+	}
+	return nil
+}
+
+// leaf returns the leaf for key, which must be in the proof.
+func (proof *RangeProof) leaf(key []byte) proofLeafNode {
+	for _, leaf := range proof.Leaves {
+		if bytes.Equal(leaf.Key, key) {
+			return leaf
+		}
+	}
+	panic(fmt.Sprintf("leaf %X not found in proof", key))
+}
+
+// GetUnchangedWithProof returns the value of key, or nil if it doesn't exist,
+// with a proof that it's the same in version and in the later version after.
+// It fails if the key was written in between, even with the same value.
+func (tree *MutableTree) GetUnchangedWithProof(key []byte, version, after int64) ([]byte, *UnchangedProof, error) {
+	if after < version {
+		return nil, nil, cmn.NewError("version %d is before version %d", after, version)
+	}
+	value, proofBefore, err := tree.GetVersionedWithProof(key, version)
+	if err != nil {
+		return nil, nil, err
+	}
+	valueAfter, proofAfter, err := tree.GetVersionedWithProof(key, after)
+	if err != nil {
+		return nil, nil, err
+	}
+	if proofBefore == nil || proofAfter == nil {
+		return nil, nil, cmn.NewError("cannot prove unchanged key in an empty tree")
+	}
+	if !bytes.Equal(value, valueAfter) || (value == nil) != (valueAfter == nil) {
+		return nil, nil, cmn.NewError("key %X was changed between versions %d and %d", key, version, after)
+	}
+	if value != nil && proofAfter.leaf(key).Version > version {
+		return nil, nil, cmn.NewError("key %X was written between versions %d and %d", key, version, after)
+	}
+	return value, &UnchangedProof{Before: proofBefore, After: proofAfter}, nil
+}
@@ -3,6 +3,7 @@ package iavl
 import (
 	"bytes"
 	"flag"
+	"fmt"
 	"os"
 	"runtime"
 	"strconv"
@@ -72,7 +73,7 @@ func TestVersionedRandomTree(t *testing.T) {
 		tree.DeleteVersion(int64(i))
 	}
 
-	require.Len(tree.versions, 1, "tree must have one version left")
+	require.Len(tree.AvailableVersions(), 1, "tree must have one version left")
 	tr, err := tree.GetImmutable(int64(versions))
 	require.NoError(err, "GetImmutable should not error for version %d", versions)
 	require.Equal(tr.root, tree.root)
@@ -313,7 +314,7 @@ func TestVersionedTree(t *testing.T) {
 	_, err = tree.Load()
 	require.NoError(err)
 
-	require.Len(tree.versions, 2, "wrong number of versions")
+	require.Len(tree.AvailableVersions(), 2, "wrong number of versions")
 	require.EqualValues(v2, tree.Version())
 
 	// -----1-----
@@ -1231,6 +1232,442 @@ func TestLoadVersionForOverwriting(t *testing.T) {
 	require.NoError(err, "SaveVersion should not fail.")
 }
 
+func TestFork(t *testing.T) {
+	require := require.New(t)
+
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	tree.Set([]byte("a"), []byte("1"))
+	tree.Set([]byte("b"), []byte("2"))
+	_, _, err := tree.SaveVersion()
+	require.NoError(err)
+
+	tree.Set([]byte("c"), []byte("3"))
+	hash := tree.WorkingHash()
+
+	fork := tree.Fork()
+	require.True(fork.IsFork())
+	require.Equal(hash, fork.WorkingHash())
+
+	fork.Set([]byte("a"), []byte("changed"))
+	fork.Remove([]byte("b"))
+	fork.Set([]byte("d"), []byte("4"))
+
+	// The parent is unaffected by changes to the fork.
+	require.Equal(hash, tree.WorkingHash())
+	_, val := tree.Get([]byte("a"))
+	require.Equal([]byte("1"), val)
+	require.True(tree.Has([]byte("b")))
+	require.False(tree.Has([]byte("d")))
+
+	_, val = fork.Get([]byte("a"))
+	require.Equal([]byte("changed"), val)
+	require.False(fork.Has([]byte("b")))
+	require.NotEqual(hash, fork.WorkingHash())
+
+	// Forks can't save versions.
+	_, _, err = fork.SaveVersion()
+	require.Error(err)
+
+	// Discarded forks leave no trace.
+	discarded := tree.Fork()
+	discarded.Set([]byte("e"), []byte("5"))
+	require.Equal(hash, tree.WorkingHash())
+
+	forkHash := fork.WorkingHash()
+	require.NoError(tree.Merge(fork))
+	require.Error(tree.Merge(fork), "a fork can only be merged once")
+	require.Equal(forkHash, tree.WorkingHash())
+
+	_, version, err := tree.SaveVersion()
+	require.NoError(err)
+	require.EqualValues(2, version)
+	require.Equal(forkHash, tree.Hash())
+
+	// The merged changes were persisted, including orphans.
+	tree.DeleteVersion(1)
+	reloaded := NewMutableTree(tree.ndb.db, 0)
+	_, err = reloaded.Load()
+	require.NoError(err)
+	require.Equal(forkHash, reloaded.Hash())
+	require.Len(reloaded.ndb.nodes(), reloaded.nodeSize())
+}
+
+func TestForkMergeConflict(t *testing.T) {
+	require := require.New(t)
+
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	tree.Set([]byte("a"), []byte("1"))
+
+	fork := tree.Fork()
+	fork.Set([]byte("b"), []byte("2"))
+
+	other := NewMutableTree(db.NewMemDB(), 0)
+	require.Error(other.Merge(fork), "fork of a different tree")
+
+	tree.Set([]byte("c"), []byte("3"))
+	require.Error(tree.Merge(fork), "working tree changed after fork")
+	require.False(tree.Has([]byte("b")))
+}
+
+func TestParallelSave(t *testing.T) {
+	require := require.New(t)
+	sequential := NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{SaveWorkers: 1})
+	parallel := NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{SaveWorkers: 8})
+
+	r := mathrand.New(mathrand.NewSource(1))
+	for v := 0; v < 5; v++ {
+		for i := 0; i < 2000; i++ {
+			key, value := []byte(fmt.Sprint(r.Intn(5000))), []byte(fmt.Sprint(v))
+			sequential.Set(key, value)
+			parallel.Set(key, value)
+		}
+		hash, _, err := sequential.SaveVersion()
+		require.NoError(err)
+		parallelHash, _, err := parallel.SaveVersion()
+		require.NoError(err)
+		require.Equal(hash, parallelHash)
+	}
+	require.Equal(sequential.ndb.nodes(), parallel.ndb.nodes())
+
+	// Options without workers use one per CPU.
+	tree := NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{AsyncCommit: true})
+	require.Equal(runtime.NumCPU(), tree.ndb.opts.SaveWorkers)
+}
+
+func TestAsyncCommit(t *testing.T) {
+	require := require.New(t)
+
+	mdb := db.NewMemDB()
+	tree := NewMutableTreeWithOpts(mdb, 0, &Options{AsyncCommit: true})
+	syncTree := NewMutableTree(db.NewMemDB(), 0)
+
+	versions := 10
+	for i := 1; i <= versions; i++ {
+		for j := 0; j < 20; j++ {
+			k, v := []byte(random.Str(2)), []byte(random.Str(8))
+			tree.Set(k, v)
+			syncTree.Set(k, v)
+		}
+		if i%3 == 0 {
+			k := []byte(random.Str(2))
+			tree.Remove(k)
+			syncTree.Remove(k)
+		}
+		hash, version, err := tree.SaveVersion()
+		require.NoError(err)
+		syncHash, _, err := syncTree.SaveVersion()
+		require.NoError(err)
+		require.Equal(syncHash, hash)
+		require.EqualValues(i, version)
+
+		// The version is readable before it is flushed.
+		it, err := tree.GetImmutable(version)
+		require.NoError(err)
+		require.Equal(hash, it.Hash())
+		require.Equal(syncTree.ImmutableTree.String(), it.String())
+
+		if i > 2 {
+			require.NoError(tree.DeleteVersion(int64(i - 2)))
+			require.NoError(syncTree.DeleteVersion(int64(i - 2)))
+		}
+	}
+	require.NoError(tree.Close())
+
+	require.Equal(syncTree.ndb.String(), tree.ndb.String())
+	require.Empty(tree.ndb.pendingNodes)
+	require.Empty(tree.ndb.pendingRoots)
+
+	reloaded := NewMutableTree(mdb, 0)
+	version, err := reloaded.Load()
+	require.NoError(err)
+	require.EqualValues(versions, version)
+	require.Equal(syncTree.Hash(), reloaded.Hash())
+}
+
+// failingDB is a database whose batches fail to be written while fail is set.
+// If block is set, writing batches waits until it is closed.
+type failingDB struct {
+	db.DB
+	fail  bool
+	block chan struct{}
+}
+
+func (fdb *failingDB) NewBatch() db.Batch {
+	return &failingBatch{fdb.DB.NewBatch(), fdb}
+}
+
+type failingBatch struct {
+	db.Batch
+	db *failingDB
+}
+
+func (b *failingBatch) Write() {
+	b.check()
+	b.Batch.Write()
+}
+
+func (b *failingBatch) WriteSync() {
+	b.check()
+	b.Batch.WriteSync()
+}
+
+func (b *failingBatch) check() {
+	if b.db.block != nil {
+		<-b.db.block
+	}
+	if b.db.fail {
+		panic("write failed")
+	}
+}
+
+func TestAsyncCommitError(t *testing.T) {
+	require := require.New(t)
+
+	fdb := &failingDB{DB: db.NewMemDB()}
+	tree := NewMutableTreeWithOpts(fdb, 0, &Options{AsyncCommit: true})
+	listener := &recordingListener{}
+	tree.AddListener(listener)
+	for i := 1; i <= 3; i++ {
+		tree.Set([]byte("k"), []byte{byte(i)})
+		_, _, err := tree.SaveVersion()
+		require.NoError(err)
+	}
+	require.NoError(tree.DeleteVersion(2))
+	require.NoError(tree.Flush())
+	require.Len(listener.saved, 3)
+	nodes := len(tree.ndb.nodes())
+
+	// Saving a version before the latest one fails right away.
+	_, err := tree.LoadVersion(1)
+	require.NoError(err)
+	tree.Set([]byte("k"), []byte{2})
+	_, _, err = tree.SaveVersion()
+	require.Error(err)
+	require.False(tree.VersionExists(2))
+	require.NoError(tree.Flush())
+	_, err = tree.LoadVersion(3)
+	require.NoError(err)
+
+	// A save which fails in the background is discarded, without notifying
+	// the listeners, and the error is reported by Flush and subsequent saves.
+	fdb.fail = true
+	tree.Set([]byte("k"), []byte{4})
+	tree.Set([]byte("k4"), []byte{4})
+	_, version, err := tree.SaveVersion()
+	require.NoError(err)
+	require.EqualValues(4, version)
+	require.Error(tree.Flush())
+	require.False(tree.VersionExists(4))
+	require.Len(listener.saved, 3)
+	_, _, err = tree.SaveVersion()
+	require.Error(err)
+	require.Error(tree.Close())
+
+	// The versions written before the failure are intact.
+	fdb.fail = false
+	tree = NewMutableTree(fdb, 0)
+	version, err = tree.Load()
+	require.NoError(err)
+	require.EqualValues(3, version)
+	require.Equal([]int64{1, 3}, tree.AvailableVersions())
+	_, value := tree.Get([]byte("k"))
+	require.Equal([]byte{3}, value)
+	require.Len(tree.ndb.nodes(), nodes)
+}
+
+func TestLazyLoadVersion(t *testing.T) {
+	require := require.New(t)
+
+	mdb := db.NewMemDB()
+	tree := NewMutableTree(mdb, 0)
+	maxVersions := 10
+
+	version, err := tree.LazyLoadVersion(0)
+	require.NoError(err, "unexpected error")
+	require.Equal(version, int64(0), "expected latest version to be zero")
+
+	for i := 0; i < maxVersions; i++ {
+		tree.Set([]byte(fmt.Sprintf("key_%d", i+1)), []byte(fmt.Sprintf("value_%d", i+1)))
+		_, _, err = tree.SaveVersion()
+		require.NoError(err, "SaveVersion should not fail")
+	}
+	require.NoError(tree.DeleteVersion(3))
+
+	// require the ability to lazy load the latest version
+	tree = NewMutableTree(mdb, 0)
+	version, err = tree.LazyLoadVersion(int64(maxVersions))
+	require.NoError(err, "unexpected error when lazy loading version")
+	require.Equal(version, int64(maxVersions))
+
+	_, value := tree.Get([]byte(fmt.Sprintf("key_%d", maxVersions)))
+	require.Equal(value, []byte(fmt.Sprintf("value_%d", maxVersions)), "unexpected value")
+
+	// all versions are available without having been loaded
+	require.True(tree.VersionExists(1))
+	require.False(tree.VersionExists(3))
+	require.Equal([]int64{1, 2, 4, 5, 6, 7, 8, 9, 10}, tree.AvailableVersions())
+	_, value = tree.GetVersioned([]byte("key_2"), 2)
+	require.Equal([]byte("value_2"), value)
+
+	// require the ability to lazy load an older version
+	version, err = tree.LazyLoadVersion(int64(maxVersions - 1))
+	require.NoError(err, "unexpected error when lazy loading version")
+	require.Equal(version, int64(maxVersions-1))
+
+	_, value = tree.Get([]byte(fmt.Sprintf("key_%d", maxVersions-1)))
+	require.Equal(value, []byte(fmt.Sprintf("value_%d", maxVersions-1)), "unexpected value")
+
+	// require the inability to lazy load a non-valid version
+	version, err = tree.LazyLoadVersion(int64(maxVersions + 1))
+	require.Error(err, "expected error when lazy loading version")
+	require.Equal(version, int64(maxVersions))
+	_, err = tree.LazyLoadVersion(3)
+	require.Error(err, "expected error when lazy loading a deleted version")
+
+	// a lazy loaded tree can be written to and pruned
+	tree = NewMutableTree(mdb, 0)
+	_, err = tree.LazyLoadVersion(0)
+	require.NoError(err)
+	tree.Set([]byte("key_1"), []byte("changed"))
+	_, version, err = tree.SaveVersion()
+	require.NoError(err)
+	require.EqualValues(maxVersions+1, version)
+	for _, v := range tree.AvailableVersions() {
+		if v != version {
+			require.NoError(tree.DeleteVersion(v))
+		}
+	}
+	require.Equal([]int64{version}, tree.AvailableVersions())
+	require.Equal(tree.nodeSize(), len(tree.ndb.nodes()))
+}
+
+func TestInitialVersion(t *testing.T) {
+	require := require.New(t)
+
+	mdb := db.NewMemDB()
+	tree := NewMutableTreeWithOpts(mdb, 0, &Options{InitialVersion: 1000000})
+	require.EqualValues(1000000, tree.WorkingVersion())
+
+	tree.Set([]byte("a"), []byte{1})
+	tree.Set([]byte("b"), []byte{2})
+	_, version, err := tree.SaveVersion()
+	require.NoError(err)
+	require.EqualValues(1000000, version)
+
+	tree.Set([]byte("c"), []byte{3})
+	_, version, err = tree.SaveVersion()
+	require.NoError(err)
+	require.EqualValues(1000001, version)
+
+	// Nodes carry the version they were saved at.
+	_, proof, err := tree.GetWithProof([]byte("c"))
+	require.NoError(err)
+	require.EqualValues(1000001, proof.Leaves[0].Version)
+
+	// The nodes created before a gap take the version they are saved at, and
+	// forks sharing them are left unchanged.
+	tree.Set([]byte("d"), []byte{4})
+	tree.Remove([]byte("a"))
+	fork := tree.Fork()
+	forkHash := fork.WorkingHash()
+	hash, version, err := tree.SaveVersionAt(1000005)
+	require.NoError(err)
+	require.EqualValues(1000005, version)
+	require.NotEqual(forkHash, hash)
+	require.Equal(forkHash, fork.WorkingHash())
+	require.EqualValues(1000005, tree.root.version)
+	_, proof, err = tree.GetWithProof([]byte("d"))
+	require.NoError(err)
+	require.EqualValues(1000005, proof.Leaves[0].Version)
+	for _, node := range tree.ndb.nodes() {
+		require.Contains([]int64{1000000, 1000001, 1000005}, node.version)
+	}
+	value, unchanged, err := tree.GetUnchangedWithProof([]byte("b"), 1000001, 1000005)
+	require.NoError(err)
+	require.NoError(unchanged.Verify([]byte("b"), value, 1000001, tree.ndb.getRoot(1000001), hash))
+	_, _, err = tree.GetUnchangedWithProof([]byte("d"), 1000001, 1000005)
+	require.Error(err)
+	require.EqualValues(1000006, tree.WorkingVersion())
+
+	// The initial version is ignored once versions have been saved.
+	tree = NewMutableTreeWithOpts(mdb, 0, &Options{InitialVersion: 5})
+	version, err = tree.Load()
+	require.NoError(err)
+	require.EqualValues(1000005, version)
+	require.EqualValues(1000006, tree.WorkingVersion())
+}
+
+func TestSaveVersionAt(t *testing.T) {
+	require := require.New(t)
+
+	mdb := db.NewMemDB()
+	tree := NewMutableTree(mdb, 0)
+
+	tree.Set([]byte("a"), []byte{1})
+	tree.Set([]byte("b"), []byte{1})
+	_, _, err := tree.SaveVersionAt(10)
+	require.NoError(err)
+
+	tree.Set([]byte("a"), []byte{2})
+	_, _, err = tree.SaveVersionAt(10)
+	require.Error(err, "versions must be increasing")
+	_, _, err = tree.SaveVersionAt(5)
+	require.Error(err, "versions must be increasing")
+	_, version, err := tree.SaveVersionAt(20)
+	require.NoError(err)
+	require.EqualValues(20, version)
+
+	tree.Set([]byte("b"), []byte{2})
+	tree.Set([]byte("c"), []byte{3})
+	_, version, err = tree.SaveVersion()
+	require.NoError(err)
+	require.EqualValues(21, version)
+
+	require.Equal([]int64{10, 20, 21}, tree.AvailableVersions())
+	require.False(tree.VersionExists(15))
+	_, val := tree.GetVersioned([]byte("a"), 10)
+	require.Equal([]byte{1}, val)
+	_, val = tree.GetVersioned([]byte("b"), 20)
+	require.Equal([]byte{1}, val)
+
+	// Orphans are tracked across the gaps, and are deleted along with the last
+	// version that needs them.
+	require.NoError(tree.DeleteVersion(20))
+	_, val = tree.GetVersioned([]byte("a"), 10)
+	require.Equal([]byte{1}, val)
+	require.NoError(tree.DeleteVersion(10))
+	require.Equal(tree.nodeSize(), len(tree.ndb.nodes()))
+
+	tree = NewMutableTree(mdb, 0)
+	version, err = tree.Load()
+	require.NoError(err)
+	require.EqualValues(21, version)
+	_, err = tree.LoadVersion(15)
+	require.Error(err)
+}
+
+func TestLoadVersionForOverwritingWithGaps(t *testing.T) {
+	require := require.New(t)
+
+	mdb := db.NewMemDB()
+	tree := NewMutableTree(mdb, 0)
+	for _, v := range []int64{2, 4, 8, 16} {
+		tree.Set([]byte{byte(v)}, []byte{byte(v)})
+		_, _, err := tree.SaveVersionAt(v)
+		require.NoError(err)
+	}
+
+	tree = NewMutableTree(mdb, 0)
+	_, err := tree.LoadVersionForOverwriting(4)
+	require.NoError(err)
+	require.Equal([]int64{2, 4}, tree.AvailableVersions())
+
+	tree.Set([]byte("new"), []byte{1})
+	_, version, err := tree.SaveVersion()
+	require.NoError(err)
+	require.EqualValues(5, version)
+}
+
 //////////////////////////// BENCHMARKS ///////////////////////////////////////
 
 func BenchmarkTreeLoadAndDelete(b *testing.B) {
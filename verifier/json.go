@@ -0,0 +1,114 @@
+package verifier
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// ProofJSONVersion is the version of the canonical JSON encoding of proofs
+// which UnmarshalProofJSON decodes.
+const ProofJSONVersion = 1
+
+// ProofJSON is a proof in the canonical JSON encoding of the iavl package,
+// written by its MarshalProofJSON and described in its PROOF_SPEC.md. Type is
+// "iavl:range_proof" for a bare range proof, or the type of a proof operator.
+// Key is set for proof operators, and End for ranges which aren't open at the
+// end. Proof is nil only for proof operators on an empty tree.
+type ProofJSON struct {
+	Type  string
+	Key   []byte
+	End   []byte
+	Proof *RangeProof
+}
+
+type proofJSON struct {
+	Version int             `json:"version"`
+	Type    string          `json:"type"`
+	Key     *HexBytes       `json:"key"`
+	End     *HexBytes       `json:"end"`
+	Proof   *rangeProofJSON `json:"proof"`
+}
+
+type rangeProofJSON struct {
+	LeftPath   []innerNodeJSON   `json:"left_path"`
+	InnerNodes [][]innerNodeJSON `json:"inner_nodes"`
+	Leaves     []leafNodeJSON    `json:"leaves"`
+}
+
+// 64-bit integers are encoded as decimal strings.
+type innerNodeJSON struct {
+	Height  int8     `json:"height"`
+	Size    int64    `json:"size,string"`
+	Version int64    `json:"version,string"`
+	Left    HexBytes `json:"left"`
+	Right   HexBytes `json:"right"`
+}
+
+type leafNodeJSON struct {
+	Key       HexBytes `json:"key"`
+	ValueHash HexBytes `json:"value_hash"`
+	Version   int64    `json:"version,string"`
+}
+
+// UnmarshalProofJSON decodes a proof in the canonical JSON encoding of the
+// iavl package. Unlike the iavl package, it doesn't insist on the canonical
+// form, and leaves checking the proof's hashes to Verify.
+func UnmarshalProofJSON(bz []byte) (*ProofJSON, error) {
+	dec := json.NewDecoder(bytes.NewReader(bz))
+	dec.DisallowUnknownFields()
+	var pj proofJSON
+	if err := dec.Decode(&pj); err != nil {
+		return nil, wrapError(ErrInvalidInputs, "decoding proof JSON: %v", err)
+	}
+	if pj.Version != ProofJSONVersion {
+		return nil, wrapError(ErrInvalidInputs, "unknown proof JSON version %d", pj.Version)
+	}
+
+	proof := &ProofJSON{Type: pj.Type}
+	if pj.Key != nil {
+		proof.Key = *pj.Key
+	}
+	if pj.End != nil {
+		proof.End = *pj.End
+	}
+	if pj.Proof != nil {
+		proof.Proof = &RangeProof{
+			LeftPath:   pathFromJSON(pj.Proof.LeftPath),
+			InnerNodes: make([]PathToLeaf, 0, len(pj.Proof.InnerNodes)),
+			Leaves:     make([]LeafNode, 0, len(pj.Proof.Leaves)),
+		}
+		for _, path := range pj.Proof.InnerNodes {
+			proof.Proof.InnerNodes = append(proof.Proof.InnerNodes, pathFromJSON(path))
+		}
+		for _, leaf := range pj.Proof.Leaves {
+			proof.Proof.Leaves = append(proof.Proof.Leaves, LeafNode{
+				Key:       leaf.Key,
+				ValueHash: leaf.ValueHash,
+				Version:   leaf.Version,
+			})
+		}
+	}
+	return proof, nil
+}
+
+func pathFromJSON(pj []innerNodeJSON) PathToLeaf {
+	path := make(PathToLeaf, 0, len(pj))
+	for _, pin := range pj {
+		path = append(path, InnerNode{
+			Height:  pin.Height,
+			Size:    pin.Size,
+			Version: pin.Version,
+			Left:    orNil(pin.Left),
+			Right:   orNil(pin.Right),
+		})
+	}
+	return path
+}
+
+// orNil returns nil for an empty hash, which is encoded as "".
+func orNil(bz []byte) []byte {
+	if len(bz) == 0 {
+		return nil
+	}
+	return bz
+}
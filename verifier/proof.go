@@ -0,0 +1,189 @@
+// Package verifier verifies IAVL proofs using only the standard library, for
+// light clients and other builds which can't pull in the tree, its database
+// or amino.
+//
+// The types have the same fields as the corresponding proof types of the iavl
+// package, and the same encoding/json form, so proofs serialized there with
+// encoding/json can be decoded and verified here. Proofs in the canonical JSON
+// of the iavl package's MarshalProofJSON are decoded with UnmarshalProofJSON.
+// The amino JSON encoding, which quotes 64-bit integers, isn't supported.
+package verifier
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrInvalidProof is returned by Verify when a proof cannot be validated.
+	ErrInvalidProof = errors.New("invalid proof")
+
+	// ErrInvalidInputs is returned when the inputs passed to the function are invalid.
+	ErrInvalidInputs = errors.New("invalid inputs")
+
+	// ErrInvalidRoot is returned when the root passed in does not match the proof's.
+	ErrInvalidRoot = errors.New("invalid root")
+)
+
+// Error annotates one of the errors above, which is its Cause.
+type Error struct {
+	Err error
+	Msg string
+}
+
+func (err *Error) Error() string {
+	return fmt.Sprintf("%v: %v", err.Err, err.Msg)
+}
+
+// Cause returns the annotated error.
+func (err *Error) Cause() error {
+	return err.Err
+}
+
+func wrapError(err error, format string, args ...interface{}) error {
+	return &Error{Err: err, Msg: fmt.Sprintf(format, args...)}
+}
+
+//----------------------------------------
+
+// HexBytes is a byte slice which is encoded in JSON as an upper case hex
+// string, like the leaf fields of iavl proofs.
+type HexBytes []byte
+
+func (bz HexBytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(strings.ToUpper(hex.EncodeToString(bz)))
+}
+
+func (bz *HexBytes) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	*bz = b
+	return nil
+}
+
+//----------------------------------------
+
+// InnerNode is an inner node on the path to a leaf. Exactly one of Left and
+// Right is set, to the hash of the child not on the path.
+type InnerNode struct {
+	Height  int8   `json:"height"`
+	Size    int64  `json:"size"`
+	Version int64  `json:"version"`
+	Left    []byte `json:"left"`
+	Right   []byte `json:"right"`
+}
+
+// Hash returns the hash of the node, given the hash of its child on the path.
+func (pin InnerNode) Hash(childHash []byte) []byte {
+	buf := new(bytes.Buffer)
+	encodeVarint(buf, int64(pin.Height))
+	encodeVarint(buf, pin.Size)
+	encodeVarint(buf, pin.Version)
+	if len(pin.Left) == 0 {
+		encodeByteSlice(buf, childHash)
+		encodeByteSlice(buf, pin.Right)
+	} else {
+		encodeByteSlice(buf, pin.Left)
+		encodeByteSlice(buf, childHash)
+	}
+	hash := sha256.Sum256(buf.Bytes())
+	return hash[:]
+}
+
+// LeafNode is a leaf, with the hash of its value.
+type LeafNode struct {
+	Key       HexBytes `json:"key"`
+	ValueHash HexBytes `json:"value"`
+	Version   int64    `json:"version"`
+}
+
+// Hash returns the hash of the leaf.
+func (pln LeafNode) Hash() []byte {
+	buf := new(bytes.Buffer)
+	encodeVarint(buf, 0)
+	encodeVarint(buf, 1)
+	encodeVarint(buf, pln.Version)
+	encodeByteSlice(buf, pln.Key)
+	encodeByteSlice(buf, pln.ValueHash)
+	hash := sha256.Sum256(buf.Bytes())
+	return hash[:]
+}
+
+// encodeVarint writes i like amino.EncodeVarint.
+func encodeVarint(buf *bytes.Buffer, i int64) {
+	var bz [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(bz[:], i)
+	buf.Write(bz[:n])
+}
+
+// encodeByteSlice writes bz like amino.EncodeByteSlice.
+func encodeByteSlice(buf *bytes.Buffer, bz []byte) {
+	var lbz [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lbz[:], uint64(len(bz)))
+	buf.Write(lbz[:n])
+	buf.Write(bz)
+}
+
+//----------------------------------------
+
+// PathToLeaf is the path from the root of a tree, which comes first, to a
+// leaf.
+type PathToLeaf []InnerNode
+
+// ComputeRootHash returns the root hash of the path, given the leaf's hash.
+func (pl PathToLeaf) ComputeRootHash(leafHash []byte) []byte {
+	hash := leafHash
+	for i := len(pl) - 1; i >= 0; i-- {
+		hash = pl[i].Hash(hash)
+	}
+	return hash
+}
+
+// Index returns the index of the leaf in the tree, or -1 if the path is
+// invalid.
+func (pl PathToLeaf) Index() (idx int64) {
+	for i, node := range pl {
+		if node.Left == nil {
+			continue
+		} else if node.Right == nil {
+			if i < len(pl)-1 {
+				idx += node.Size - pl[i+1].Size
+			} else {
+				idx += node.Size - 1
+			}
+		} else {
+			return -1
+		}
+	}
+	return idx
+}
+
+func (pl PathToLeaf) isLeftmost() bool {
+	for _, node := range pl {
+		if len(node.Left) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (pl PathToLeaf) isRightmost() bool {
+	for _, node := range pl {
+		if len(node.Right) > 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,195 @@
+package verifier
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"sort"
+)
+
+// RangeProof proves a sequence of consecutive leaves of a tree. LeftPath is
+// the path to the first leaf, and InnerNodes holds the rest of the path to
+// each following leaf.
+type RangeProof struct {
+	LeftPath   PathToLeaf   `json:"left_path"`
+	InnerNodes []PathToLeaf `json:"inner_nodes"`
+	Leaves     []LeafNode   `json:"leaves"`
+
+	// memoize
+	rootVerified bool
+	treeEnd      bool // valid iff rootVerified is true
+}
+
+// Verify checks that the proof is valid for the given root hash. It must be
+// called before VerifyItem and VerifyAbsence.
+func (proof *RangeProof) Verify(root []byte) error {
+	if proof == nil {
+		return wrapError(ErrInvalidProof, "proof is nil")
+	}
+	rootHash, treeEnd, err := proof.ComputeRootHash()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(rootHash, root) {
+		return wrapError(ErrInvalidRoot, "root hash doesn't match")
+	}
+	proof.rootVerified = true
+	proof.treeEnd = treeEnd
+	return nil
+}
+
+// TreeEnd returns whether the last leaf of the proof is the last one of the
+// tree. It is only valid once Verify succeeded.
+func (proof *RangeProof) TreeEnd() bool {
+	return proof.treeEnd
+}
+
+// VerifyItem checks that key has value in the proof.
+func (proof *RangeProof) VerifyItem(key, value []byte) error {
+	if proof == nil {
+		return wrapError(ErrInvalidProof, "proof is nil")
+	}
+	if !proof.rootVerified {
+		return errors.New("must call Verify(root) first")
+	}
+	leaves := proof.Leaves
+	i := sort.Search(len(leaves), func(i int) bool {
+		return bytes.Compare(key, leaves[i].Key) <= 0
+	})
+	if i >= len(leaves) || !bytes.Equal(leaves[i].Key, key) {
+		return wrapError(ErrInvalidProof, "leaf key not found in proof")
+	}
+	valueHash := sha256.Sum256(value)
+	if !bytes.Equal(leaves[i].ValueHash, valueHash[:]) {
+		return wrapError(ErrInvalidProof, "leaf value hash not same")
+	}
+	return nil
+}
+
+// VerifyAbsence checks that the proof shows key is absent, with the leaves
+// on either side of it, or with the first or last leaf of the tree.
+func (proof *RangeProof) VerifyAbsence(key []byte) error {
+	if proof == nil {
+		return wrapError(ErrInvalidProof, "proof is nil")
+	}
+	if !proof.rootVerified {
+		return errors.New("must call Verify(root) first")
+	}
+	cmp := bytes.Compare(key, proof.Leaves[0].Key)
+	if cmp < 0 {
+		if proof.LeftPath.isLeftmost() {
+			return nil
+		}
+		return errors.New("absence not proved by left path")
+	} else if cmp == 0 {
+		return wrapError(ErrInvalidProof, "absence disproved via first item #0")
+	}
+	if len(proof.LeftPath) == 0 || proof.LeftPath.isRightmost() {
+		return nil
+	}
+
+	// See if any of the leaves are greater than key.
+	for i := 1; i < len(proof.Leaves); i++ {
+		cmp := bytes.Compare(key, proof.Leaves[i].Key)
+		if cmp < 0 {
+			return nil
+		} else if cmp == 0 {
+			return wrapError(ErrInvalidProof, "absence disproved via item #%v", i)
+		}
+	}
+
+	// It's still a valid proof if our last leaf is the rightmost child.
+	if proof.treeEnd {
+		return nil
+	}
+	return errors.New("absence not proved by right leaf")
+}
+
+// ComputeRootHash returns the root hash of the tree from the leaves and
+// paths, and whether the last leaf is the last one of the tree. It doesn't
+// verify the root hash.
+func (proof *RangeProof) ComputeRootHash() (rootHash []byte, treeEnd bool, err error) {
+	if proof == nil {
+		return nil, false, wrapError(ErrInvalidProof, "proof is nil")
+	}
+	if len(proof.Leaves) == 0 {
+		return nil, false, wrapError(ErrInvalidProof, "no leaves")
+	}
+	if len(proof.InnerNodes)+1 != len(proof.Leaves) {
+		return nil, false, wrapError(ErrInvalidProof, "InnerNodes vs Leaves length mismatch, leaves should be 1 more.")
+	}
+
+	// Start from the left path and prove each leaf.
+
+	// shared across recursive calls
+	var leaves = proof.Leaves
+	var innersq = proof.InnerNodes
+	var COMPUTEHASH func(path PathToLeaf, rightmost bool) (hash []byte, treeEnd bool, done bool, err error)
+
+	// rightmost: is the root a rightmost child of the tree?
+	// treeEnd: true iff the last leaf is the last item of the tree.
+	// Returns the (possibly intermediate, possibly root) hash.
+	COMPUTEHASH = func(path PathToLeaf, rightmost bool) (hash []byte, treeEnd bool, done bool, err error) {
+
+		// Pop next leaf.
+		nleaf, rleaves := leaves[0], leaves[1:]
+		leaves = rleaves
+
+		// Compute hash.
+		hash = path.ComputeRootHash(nleaf.Hash())
+
+		// If we don't have any leaves left, we're done.
+		if len(leaves) == 0 {
+			rightmost = rightmost && path.isRightmost()
+			return hash, rightmost, true, nil
+		}
+
+		// Prove along path (until we run out of leaves).
+		for len(path) > 0 {
+
+			// Drop the leaf-most (last-most) inner nodes from path
+			// until we encounter one with a right hash.
+			// We assume that the left side is already verified.
+			// rpath: rest of path
+			// lpath: last path item
+			rpath, lpath := path[:len(path)-1], path[len(path)-1]
+			path = rpath
+			if len(lpath.Right) == 0 {
+				continue
+			}
+
+			// Pop next inners, a PathToLeaf (e.g. []InnerNode).
+			if len(innersq) == 0 {
+				return nil, false, false, wrapError(ErrInvalidProof, "missing inner nodes")
+			}
+			inners, rinnersq := innersq[0], innersq[1:]
+			innersq = rinnersq
+
+			// Recursively verify inners against remaining leaves.
+			derivedRoot, treeEnd, done, err := COMPUTEHASH(inners, rightmost && rpath.isRightmost())
+			if err != nil {
+				return nil, treeEnd, false, err
+			}
+			if !bytes.Equal(derivedRoot, lpath.Right) {
+				return nil, treeEnd, false, wrapError(ErrInvalidRoot, "intermediate root hash %X doesn't match, got %X", lpath.Right, derivedRoot)
+			}
+			if done {
+				return hash, treeEnd, true, nil
+			}
+		}
+
+		// We're not done yet (leaves left over). No error, not done either.
+		// Technically if rightmost, we know there's an error "left over leaves
+		// -- malformed proof", but we return that at the top level, below.
+		return hash, false, false, nil
+	}
+
+	// Verify!
+	rootHash, treeEnd, done, err := COMPUTEHASH(proof.LeftPath, true)
+	if err != nil {
+		return nil, treeEnd, err
+	} else if !done {
+		return nil, treeEnd, wrapError(ErrInvalidProof, "left over leaves -- malformed proof")
+	}
+	return rootHash, treeEnd, nil
+}
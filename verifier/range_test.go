@@ -0,0 +1,146 @@
+package verifier
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// The fixtures are proofs of the tree of TestVerifierPackage in the iavl
+// package, encoded to JSON there, with the root hash they are verified with.
+type fixture struct {
+	Root  HexBytes    `json:"root"`
+	Proof *RangeProof `json:"proof"`
+}
+
+func loadFixture(t *testing.T, name string) fixture {
+	bz, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var f fixture
+	if err := json.Unmarshal(bz, &f); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func cause(err error) error {
+	if verr, ok := err.(*Error); ok {
+		return verr.Cause()
+	}
+	return err
+}
+
+func TestRangeProofValid(t *testing.T) {
+	cases := []struct {
+		fixture  string
+		items    map[string]string
+		absent   []string
+		present  []string
+		notItems map[string]string
+	}{
+		{
+			fixture: "range_proof.json",
+			items: map[string]string{
+				"\x11": "\x11",
+				"\x32": "updated",
+				"\x50": "\x50",
+				"\x72": "\x72",
+				"\x99": "\x99",
+			},
+			absent:   []string{"\x00", "\x40", "\x72\x00", "\xa0"},
+			present:  []string{"\x11", "\x50", "\x99"},
+			notItems: map[string]string{"\x32": "\x32", "\x40": "\x40"},
+		},
+		{
+			fixture:  "absence_proof.json",
+			items:    map[string]string{"\x32": "updated", "\x50": "\x50"},
+			absent:   []string{"\x40"},
+			present:  []string{"\x32", "\x50"},
+			notItems: map[string]string{"\x11": "\x11", "\x50": "updated"},
+		},
+	}
+	for _, tc := range cases {
+		f := loadFixture(t, tc.fixture)
+		if err := f.Proof.VerifyItem([]byte("\x50"), []byte("\x50")); err == nil {
+			t.Errorf("%s: VerifyItem before Verify must fail", tc.fixture)
+		}
+		if err := f.Proof.Verify(f.Root); err != nil {
+			t.Fatalf("%s: %v", tc.fixture, err)
+		}
+		for key, value := range tc.items {
+			if err := f.Proof.VerifyItem([]byte(key), []byte(value)); err != nil {
+				t.Errorf("%s: item %X: %v", tc.fixture, key, err)
+			}
+		}
+		for key, value := range tc.notItems {
+			if err := f.Proof.VerifyItem([]byte(key), []byte(value)); cause(err) != ErrInvalidProof {
+				t.Errorf("%s: item %X: expected %v, got %v", tc.fixture, key, ErrInvalidProof, err)
+			}
+		}
+		for _, key := range tc.absent {
+			if err := f.Proof.VerifyAbsence([]byte(key)); err != nil {
+				t.Errorf("%s: absence of %X: %v", tc.fixture, key, err)
+			}
+		}
+		for _, key := range tc.present {
+			if err := f.Proof.VerifyAbsence([]byte(key)); err == nil {
+				t.Errorf("%s: absence of %X must not be proven", tc.fixture, key)
+			}
+		}
+	}
+}
+
+func TestRangeProofTampered(t *testing.T) {
+	cases := []struct {
+		name    string
+		fixture string
+		tamper  func(f *fixture)
+		err     error
+	}{
+		{"wrong root", "range_proof.json", func(f *fixture) {
+			f.Root[0] ^= 0xff
+		}, ErrInvalidRoot},
+		{"leaf value", "range_proof.json", func(f *fixture) {
+			f.Proof.Leaves[1].ValueHash[0] ^= 0xff
+		}, ErrInvalidRoot},
+		{"first leaf key", "absence_proof.json", func(f *fixture) {
+			f.Proof.Leaves[0].Key = HexBytes("\x33")
+		}, ErrInvalidRoot},
+		{"last leaf version", "absence_proof.json", func(f *fixture) {
+			f.Proof.Leaves[1].Version++
+		}, ErrInvalidRoot},
+		{"left path size", "range_proof.json", func(f *fixture) {
+			f.Proof.LeftPath[0].Size++
+		}, ErrInvalidRoot},
+		{"inner node hash", "absence_proof.json", func(f *fixture) {
+			f.Proof.InnerNodes[0][0].Right[0] ^= 0xff
+		}, ErrInvalidRoot},
+		{"dropped leaf", "range_proof.json", func(f *fixture) {
+			f.Proof.Leaves = f.Proof.Leaves[:len(f.Proof.Leaves)-1]
+		}, ErrInvalidProof},
+		{"dropped inner nodes", "absence_proof.json", func(f *fixture) {
+			f.Proof.InnerNodes = nil
+		}, ErrInvalidProof},
+		{"no leaves", "absence_proof.json", func(f *fixture) {
+			f.Proof.InnerNodes, f.Proof.Leaves = nil, nil
+		}, ErrInvalidProof},
+		{"nil proof", "range_proof.json", func(f *fixture) {
+			f.Proof = nil
+		}, ErrInvalidProof},
+	}
+	for _, tc := range cases {
+		f := loadFixture(t, tc.fixture)
+		tc.tamper(&f)
+		err := f.Proof.Verify(f.Root)
+		if cause(err) != tc.err {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.err, err)
+			continue
+		}
+		if err := f.Proof.VerifyAbsence([]byte("\x40")); err == nil {
+			t.Errorf("%s: VerifyAbsence must fail after Verify failed", tc.name)
+		}
+	}
+}
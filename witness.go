@@ -0,0 +1,371 @@
+package iavl
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+
+	cmn "github.com/tendermint/tendermint/libs/common"
+	dbm "github.com/tendermint/tendermint/libs/db"
+)
+
+// Witness holds the nodes of a version of a tree which are read by a series
+// of operations, encoded as in the database, so that the operations can be
+// replayed without the rest of the tree. The nodes are checked against the
+// root hash of the version when they're loaded.
+//
+// Since the keys of inner nodes aren't part of their hashes, a witness also
+// holds the paths to the in-order neighbors of each leaf read. The keys of the
+// neighbors bound those of the inner nodes on the way to the leaf, so that a
+// search reaches the same leaf as in the tree.
+type Witness struct {
+	Nodes [][]byte `json:"nodes"`
+}
+
+// nodeTrace records the nodes of a version which are read through a tree.
+type nodeTrace struct {
+	version int64
+	root    *Node
+
+	mtx   sync.Mutex // Guards nodes, as trees may be read concurrently.
+	nodes map[string]*Node
+}
+
+// newNodeTrace returns a trace of the version of t, which holds its root.
+func newNodeTrace(t *ImmutableTree) *nodeTrace {
+	trace := &nodeTrace{
+		version: t.version,
+		root:    t.root,
+		nodes:   make(map[string]*Node),
+	}
+	trace.record(t.root)
+	return trace
+}
+
+// record adds the node to the trace if it belongs to the traced version, and
+// returns it. Nodes created after that version are left out, as they aren't
+// needed to replay the operations.
+func (trace *nodeTrace) record(node *Node) *Node {
+	if trace != nil && node != nil && node.version <= trace.version {
+		trace.mtx.Lock()
+		trace.nodes[string(node.hash)] = node
+		trace.mtx.Unlock()
+	}
+	return node
+}
+
+// addNeighbors records the paths to the in-order neighbors of each leaf
+// recorded so far, through t, which must be tracing into trace.
+func (trace *nodeTrace) addNeighbors(t *ImmutableTree) {
+	trace.mtx.Lock()
+	leaves := make([]*Node, 0, len(trace.nodes))
+	for _, node := range trace.nodes {
+		if node.isLeaf() {
+			leaves = append(leaves, node)
+		}
+	}
+	trace.mtx.Unlock()
+
+	for _, leaf := range leaves {
+		// The predecessor is the rightmost leaf of the left subtree of the
+		// last node the path goes right from, and the successor the leftmost
+		// leaf of the right subtree of the last node it goes left from.
+		var predParent, succParent *Node
+		node := trace.root
+		for !node.isLeaf() {
+			if bytes.Compare(leaf.key, node.key) < 0 {
+				succParent, node = node, node.getLeftNode(t)
+			} else {
+				predParent, node = node, node.getRightNode(t)
+			}
+		}
+		if predParent != nil {
+			predParent.getLeftNode(t).rmd(t)
+		}
+		if succParent != nil {
+			succParent.getRightNode(t).lmd(t)
+		}
+	}
+}
+
+// witness returns the recorded nodes, ordered by hash.
+func (trace *nodeTrace) witness() *Witness {
+	trace.mtx.Lock()
+	defer trace.mtx.Unlock()
+	hashes := make([]string, 0, len(trace.nodes))
+	for hash := range trace.nodes {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+
+	witness := &Witness{Nodes: make([][]byte, 0, len(hashes))}
+	for _, hash := range hashes {
+		buf := new(bytes.Buffer)
+		if err := trace.nodes[hash].writeBytes(buf); err != nil {
+			panic(err)
+		}
+		witness.Nodes = append(witness.Nodes, buf.Bytes())
+	}
+	return witness
+}
+
+// load returns a tree of the given version with the root hash, backed by the
+// witness' nodes only. The keys of the nodes reached from the root are checked
+// against the keys of the leaves below them. Leaves whose in-order neighbors
+// the witness doesn't include are left out, so that they're never read.
+func (witness *Witness) load(root []byte, version int64) (*MutableTree, error) {
+	if witness == nil {
+		return nil, cmn.ErrorWrap(ErrInvalidProof, "witness is nil")
+	}
+	wn := &witnessNodes{
+		nodes:   make(map[string]*Node, len(witness.Nodes)),
+		encoded: make(map[string][]byte, len(witness.Nodes)),
+		reached: make(map[string]bool, len(witness.Nodes)),
+	}
+	for _, bz := range witness.Nodes {
+		node, err := MakeNode(bz)
+		if err != nil {
+			return nil, cmn.ErrorWrap(err, "decoding witness node")
+		}
+		hash := node._hash()
+		wn.nodes[string(hash)] = node
+		wn.encoded[string(hash)] = bz
+	}
+
+	db := dbm.NewMemDB()
+	ndb := newNodeDB(db, 0, DefaultOptions())
+	ndb.partial = true
+	t := &ImmutableTree{ndb: ndb, version: version}
+	if len(root) > 0 {
+		if wn.nodes[string(root)] == nil {
+			return nil, cmn.ErrorWrap(ErrInvalidProof, "witness doesn't include the root")
+		}
+		if err := wn.checkKeys(root, nil, nil, nil, nil); err != nil {
+			return nil, err
+		}
+		for hash := range wn.reached {
+			db.Set(ndb.nodeKey([]byte(hash)), wn.encoded[hash])
+		}
+		t.root = ndb.GetNode(root)
+	}
+	if version > 0 {
+		if err := ndb.saveRoot(append([]byte{}, root...), version); err != nil {
+			return nil, err
+		}
+		ndb.Commit()
+	}
+	return newScratchTree(t), nil
+}
+
+// witnessNodes holds the decoded nodes of a witness, by hash, and the ones
+// reached from the root.
+type witnessNodes struct {
+	nodes   map[string]*Node
+	encoded map[string][]byte
+	reached map[string]bool
+}
+
+// checkKeys checks the keys of the subtree with the hash, if it is in the
+// witness. Its keys must be in [lo, hi), where nil bounds are open. pred and
+// succ are the hashes of the subtrees holding the in-order neighbors of the
+// subtree, if any.
+func (wn *witnessNodes) checkKeys(hash, lo, hi, pred, succ []byte) error {
+	node := wn.nodes[string(hash)]
+	if node == nil {
+		return nil
+	}
+	wn.reached[string(hash)] = true
+	if (lo != nil && bytes.Compare(node.key, lo) < 0) || (hi != nil && bytes.Compare(node.key, hi) >= 0) {
+		return cmn.ErrorWrap(ErrInvalidProof, "node %X has key %X, out of [%X, %X)", hash, node.key, lo, hi)
+	}
+
+	if node.isLeaf() {
+		// Only the neighbors bound the keys of the inner nodes above, so that
+		// a search which reaches the leaf is the same as in the tree. Leaves
+		// without them are only used to check keys.
+		if (pred != nil && wn.extreme(pred, false) == nil) || (succ != nil && wn.extreme(succ, true) == nil) {
+			delete(wn.reached, string(hash))
+		}
+		return nil
+	}
+	if leaf := wn.extreme(node.rightHash, true); leaf != nil && !bytes.Equal(leaf.key, node.key) {
+		return cmn.ErrorWrap(ErrInvalidProof, "node %X has key %X, expected %X", hash, node.key, leaf.key)
+	}
+	if err := wn.checkKeys(node.leftHash, lo, node.key, pred, node.rightHash); err != nil {
+		return err
+	}
+	return wn.checkKeys(node.rightHash, node.key, hi, node.leftHash, succ)
+}
+
+// extreme returns the leftmost leaf of the subtree with the hash if left is
+// set, or its rightmost one otherwise, or nil if the witness doesn't include
+// the path to it.
+func (wn *witnessNodes) extreme(hash []byte, left bool) *Node {
+	node := wn.nodes[string(hash)]
+	for node != nil && !node.isLeaf() {
+		if left {
+			node = wn.nodes[string(node.leftHash)]
+		} else {
+			node = wn.nodes[string(node.rightHash)]
+		}
+	}
+	return node
+}
+
+// newScratchTree returns a working tree on top of t, which must not be
+// shared. It can be modified and hashed, but not saved.
+func newScratchTree(t *ImmutableTree) *MutableTree {
+	return &MutableTree{
+		ImmutableTree: t,
+		lastSaved:     t.clone(),
+		orphans:       map[string]int64{},
+		ndb:           t.ndb,
+	}
+}
+
+// recoverNotAvailable recovers from reading a node which isn't available,
+// returning the error in err. Other panics carry on.
+func recoverNotAvailable(err *error) {
+	if r := recover(); r != nil {
+		if cause, ok := r.(cmn.Error); ok && cause.Data() == ErrNotAvailable {
+			*err = cause
+			return
+		}
+		panic(r)
+	}
+}
+
+// applyOps applies the changes to the working tree, in order.
+func (tree *MutableTree) applyOps(ops ChangeSet) error {
+	for _, op := range ops {
+		if !op.Delete && op.Value == nil {
+			return cmn.ErrorWrap(ErrInvalidInputs, "nil value for key %X", op.Key)
+		}
+	}
+	for _, op := range ops {
+		if op.Delete {
+			tree.Remove(op.Key)
+		} else {
+			tree.Set(op.Key, op.Value)
+		}
+	}
+	return nil
+}
+
+//----------------------------------------
+
+// getTrace returns the trace recording the nodes read through the tree, or nil
+// if it isn't being traced.
+func (t *ImmutableTree) getTrace() *nodeTrace {
+	trace, _ := t.trace.Load().(*nodeTrace)
+	return trace
+}
+
+// setTrace sets the trace recording the nodes read through the tree, or stops
+// tracing if trace is nil.
+func (t *ImmutableTree) setTrace(trace *nodeTrace) {
+	t.trace.Store(trace)
+}
+
+// StartTracing starts recording the nodes read through the tree, replacing
+// any previous trace. Reads of concurrent users of the tree are recorded too,
+// from the time they read the trace.
+func (t *ImmutableTree) StartTracing() {
+	t.setTrace(newNodeTrace(t))
+}
+
+// StopTracing stops recording the nodes read through the tree, and returns a
+// witness from which NewMutableTreeFromWitness can load them, or nil if the
+// tree wasn't being traced. Nodes read concurrently may be left out.
+func (t *ImmutableTree) StopTracing() *Witness {
+	trace := t.getTrace()
+	if trace == nil {
+		return nil
+	}
+	trace.addNeighbors(t)
+	t.setTrace(nil)
+	return trace.witness()
+}
+
+// StartTracing starts recording the nodes of the last saved version which are
+// read through the tree, by reads and writes alike, until StopTracing. The
+// trace is kept across SaveVersion and Rollback, but not across loading a
+// version. It returns an error if the working tree has unsaved changes, as
+// the nodes they read wouldn't be recorded.
+func (tree *MutableTree) StartTracing() error {
+	if tree.root != tree.lastSaved.root {
+		return cmn.NewError("cannot start tracing a tree with unsaved changes")
+	}
+	tree.lastSaved.StartTracing()
+	tree.ImmutableTree.setTrace(tree.lastSaved.getTrace())
+	return nil
+}
+
+// StopTracing stops recording the nodes read through the tree, and returns a
+// witness of the version which was last saved when tracing started, or nil if
+// the tree wasn't being traced. Replaying the same reads and writes on the
+// tree returned by NewMutableTreeFromWitness gives the same results.
+func (tree *MutableTree) StopTracing() *Witness {
+	trace := tree.ImmutableTree.getTrace()
+	if trace == nil {
+		return nil
+	}
+	tree.ImmutableTree.setTrace(nil)
+	tree.lastSaved.setTrace(trace)
+	return tree.lastSaved.StopTracing()
+}
+
+// NewMutableTreeFromWitness returns a tree of the given version with the root
+// hash, holding only the nodes of the witness, in memory. It can be read,
+// written and saved like any other tree. Reading a node which isn't in the
+// witness panics with an error whose cause is ErrNotAvailable, which
+// ApplyBatch returns instead, leaving the working tree unchanged. Reads which
+// return ErrNotAvailable are served by a PartialTree the witness is added to.
+func NewMutableTreeFromWitness(witness *Witness, root []byte, version int64) (*MutableTree, error) {
+	return witness.load(root, version)
+}
+
+// GetUpdateWitness applies the changes to the given version, in order, and
+// returns the resulting root hash, along with a witness from which
+// VerifyUpdate can recompute it. New nodes are given the next version, as
+// SaveVersion would. The tree itself is left unchanged.
+func (tree *MutableTree) GetUpdateWitness(version int64, ops ChangeSet) ([]byte, *Witness, error) {
+	t, err := tree.GetImmutable(version)
+	if err != nil {
+		return nil, nil, err
+	}
+	scratch := newScratchTree(t)
+	trace := newNodeTrace(t)
+	t.setTrace(trace)
+
+	if err := scratch.applyOps(ops); err != nil {
+		return nil, nil, err
+	}
+	newRoot := scratch.WorkingHash()
+	trace.addNeighbors(t)
+	return newRoot, trace.witness(), nil
+}
+
+// VerifyUpdate checks that applying the changes, in order, to the version of
+// a tree with the root hash oldRoot gives the root hash newRoot, by replaying
+// them on the nodes of the witness.
+func VerifyUpdate(oldRoot, newRoot []byte, version int64, ops ChangeSet, witness *Witness) (err error) {
+	tree, err := witness.load(oldRoot, version)
+	if err != nil {
+		return err
+	}
+
+	// Reading a node which isn't in the witness panics.
+	defer func() {
+		if r := recover(); r != nil {
+			err = cmn.ErrorWrap(ErrInvalidProof, "replaying changes: %v", r)
+		}
+	}()
+	if err := tree.applyOps(ops); err != nil {
+		return err
+	}
+	if !bytes.Equal(tree.WorkingHash(), newRoot) {
+		return cmn.ErrorWrap(ErrInvalidRoot, "new root hash doesn't match")
+	}
+	return nil
+}
@@ -0,0 +1,301 @@
+package iavl
+
+import (
+	"bytes"
+	mathrand "math/rand"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tendermint/tendermint/libs/db"
+)
+
+func TestUpdateWitness(t *testing.T) {
+	require := require.New(t)
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	r := mathrand.New(mathrand.NewSource(1))
+
+	keys := [][]byte{}
+	for i := 0; i < 500; i++ {
+		key := []byte{byte(r.Intn(256)), byte(r.Intn(256))}
+		keys = append(keys, key)
+		tree.Set(key, randBytes(4))
+	}
+	oldRoot, version, err := tree.SaveVersion()
+	require.NoError(err)
+
+	ops := ChangeSet{}
+	for i := 0; i < 20; i++ {
+		switch i % 4 {
+		case 0:
+			ops = append(ops, KVChange{Key: keys[r.Intn(len(keys))], Value: randBytes(4)})
+		case 1:
+			ops = append(ops, KVChange{Key: []byte{byte(r.Intn(256)), 0x00, 0x01}, Value: randBytes(4)})
+		case 2:
+			ops = append(ops, KVChange{Key: keys[r.Intn(len(keys))], Delete: true})
+		case 3:
+			ops = append(ops, KVChange{Key: []byte("missing"), Delete: true})
+		}
+	}
+
+	newRoot, witness, err := tree.GetUpdateWitness(version, ops)
+	require.NoError(err)
+	require.Equal(oldRoot, tree.WorkingHash(), "tree must be unchanged")
+	require.True(len(witness.Nodes) < tree.nodeSize())
+
+	// The new root is the one the tree saves.
+	for _, op := range ops {
+		if op.Delete {
+			tree.Remove(op.Key)
+		} else {
+			tree.Set(op.Key, op.Value)
+		}
+	}
+	hash, _, err := tree.SaveVersion()
+	require.NoError(err)
+	require.Equal(hash, newRoot)
+
+	require.NoError(VerifyUpdate(oldRoot, newRoot, version, ops, witness))
+	require.Error(VerifyUpdate(oldRoot, oldRoot, version, ops, witness))
+	require.Error(VerifyUpdate(newRoot, newRoot, version, ops, witness))
+	require.Error(VerifyUpdate(oldRoot, newRoot, version+1, ops, witness))
+	require.Error(VerifyUpdate(oldRoot, newRoot, version, ops[1:], witness))
+
+	// A witness missing any node is rejected.
+	for i := range witness.Nodes {
+		partial := &Witness{Nodes: append(append([][]byte{}, witness.Nodes[:i]...), witness.Nodes[i+1:]...)}
+		require.Error(VerifyUpdate(oldRoot, newRoot, version, ops, partial), "node %d", i)
+	}
+
+	// Changing the key of an inner node doesn't change its hash, but is
+	// rejected too.
+	for i, bz := range witness.Nodes {
+		node, err := MakeNode(bz)
+		require.NoError(err)
+		if node.isLeaf() || !bytes.Equal(node._hash(), oldRoot) {
+			continue
+		}
+		node.key = []byte{0x00}
+		buf := new(bytes.Buffer)
+		require.NoError(node.writeBytes(buf))
+		tampered := &Witness{Nodes: append([][]byte{}, witness.Nodes...)}
+		tampered.Nodes[i] = buf.Bytes()
+		require.Error(VerifyUpdate(oldRoot, newRoot, version, ops, tampered))
+	}
+
+	// Updates to an empty version.
+	tree = NewMutableTree(db.NewMemDB(), 0)
+	tree.Set([]byte{1}, []byte{1})
+	_, _, err = tree.SaveVersion()
+	require.NoError(err)
+	tree.Remove([]byte{1})
+	_, version, err = tree.SaveVersion()
+	require.NoError(err)
+	ops = ChangeSet{{Key: []byte{2}, Value: []byte{2}}, {Key: []byte{3}, Value: []byte{3}}}
+	newRoot, witness, err = tree.GetUpdateWitness(version, ops)
+	require.NoError(err)
+	require.Empty(witness.Nodes)
+	require.NoError(VerifyUpdate(nil, newRoot, version, ops, witness))
+
+	_, _, err = tree.GetUpdateWitness(version, ChangeSet{{Key: []byte{2}}})
+	require.Error(err)
+}
+
+func TestTracingWitness(t *testing.T) {
+	require := require.New(t)
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	r := mathrand.New(mathrand.NewSource(2))
+
+	keys := [][]byte{}
+	for i := 0; i < 500; i++ {
+		key := []byte{byte(r.Intn(256)), byte(r.Intn(256))}
+		keys = append(keys, key)
+		tree.Set(key, randBytes(4))
+	}
+	root, version, err := tree.SaveVersion()
+	require.NoError(err)
+
+	// A block of reads and writes, saved as two versions.
+	block := func(tree *MutableTree) (values [][]byte, hashes [][]byte) {
+		for i := 0; i < 10; i++ {
+			_, value := tree.Get(keys[i*7])
+			values = append(values, value)
+			tree.Set(keys[i*11], []byte{byte(i)})
+			tree.Remove(keys[i*13+1])
+		}
+		hash, _, err := tree.SaveVersion()
+		require.NoError(err)
+		hashes = append(hashes, hash)
+
+		tree.Iterate(func(key, value []byte) bool {
+			values = append(values, key, value)
+			return len(values) > 40
+		})
+		tree.Set([]byte{0x01, 0x02, 0x03}, []byte{1})
+		hash, _, err = tree.SaveVersion()
+		require.NoError(err)
+		hashes = append(hashes, hash)
+		return values, hashes
+	}
+
+	tree.Set([]byte("unsaved"), []byte{1})
+	require.Error(tree.StartTracing())
+	tree.Rollback()
+
+	require.NoError(tree.StartTracing())
+	values, hashes := block(tree)
+	witness := tree.StopTracing()
+	require.Nil(tree.StopTracing())
+	require.True(len(witness.Nodes) < 2*len(keys)-1, "%d nodes", len(witness.Nodes))
+
+	partial, err := NewMutableTreeFromWitness(witness, root, version)
+	require.NoError(err)
+	require.True(partial.VersionExists(version))
+	require.Equal(root, partial.Hash())
+	partialValues, partialHashes := block(partial)
+	require.Equal(values, partialValues)
+	require.Equal(hashes, partialHashes)
+
+	// Reads outside of the witness panic.
+	partial, err = NewMutableTreeFromWitness(witness, root, version)
+	require.NoError(err)
+	require.Panics(func() {
+		partial.Iterate(func(key, value []byte) bool { return false })
+	})
+	func() {
+		defer func() {
+			requireNotAvailable(t, recover().(error))
+		}()
+		partial.Iterate(func(key, value []byte) bool { return false })
+	}()
+
+	// Batches return the error instead, and leave the tree unchanged.
+	partial, err = NewMutableTreeFromWitness(witness, root, version)
+	require.NoError(err)
+	outside := 0
+	for i, key := range keys {
+		err := partial.ApplyBatch(ChangeSet{{Key: keys[0], Value: []byte{1}}, {Key: key, Delete: true}})
+		if err == nil {
+			partial.Rollback()
+			continue
+		}
+		requireNotAvailable(t, err)
+		require.Equal(root, partial.WorkingHash(), "key %d", i)
+		outside++
+	}
+	require.NotZero(outside)
+
+	// As do the reads of a partial tree holding the witness.
+	pt := NewPartialTree(root)
+	require.NoError(pt.AddWitness(witness))
+	_, err = pt.Iterate(func(key, value []byte) bool { return false })
+	requireNotAvailable(t, err)
+	require.NoError(partial.ApplyBatch(ChangeSet{{Key: keys[0], Value: []byte{1}}}))
+
+	_, err = NewMutableTreeFromWitness(witness, hashes[0], version)
+	require.Error(err)
+
+	// Changing the key of an inner node is rejected.
+	for i, bz := range witness.Nodes {
+		node, err := MakeNode(bz)
+		require.NoError(err)
+		if node.isLeaf() || !bytes.Equal(node._hash(), root) {
+			continue
+		}
+		node.key = []byte{0x00}
+		buf := new(bytes.Buffer)
+		require.NoError(node.writeBytes(buf))
+		tampered := &Witness{Nodes: append([][]byte{}, witness.Nodes...)}
+		tampered.Nodes[i] = buf.Bytes()
+		_, loadErr := NewMutableTreeFromWitness(tampered, root, version)
+		require.Error(loadErr)
+	}
+
+	// Immutable trees can be traced too.
+	itree, err := tree.GetImmutable(version)
+	require.NoError(err)
+	itree.StartTracing()
+	_, value := itree.Get(keys[3])
+	witness = itree.StopTracing()
+	partial, err = NewMutableTreeFromWitness(witness, root, version)
+	require.NoError(err)
+	_, partialValue := partial.Get(keys[3])
+	require.Equal(value, partialValue)
+}
+
+func TestWitnessSize(t *testing.T) {
+	require := require.New(t)
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	r := mathrand.New(mathrand.NewSource(3))
+
+	for i := 0; i < 10000; i++ {
+		tree.Set(randBytes(8), randBytes(4))
+	}
+	root, version, err := tree.SaveVersion()
+	require.NoError(err)
+	itree, err := tree.GetImmutable(version)
+	require.NoError(err)
+	height := int(itree.Height())
+
+	// A lookup needs the path to the leaf it reaches and those to the leaf's
+	// neighbors, which share most of it.
+	for i := 0; i < 200; i++ {
+		key := randBytes(8)
+		if i%2 == 0 {
+			key, _ = itree.GetByIndex(r.Int63n(itree.Size()))
+		}
+		itree.StartTracing()
+		_, value := itree.Get(key)
+		witness := itree.StopTracing()
+		require.True(len(witness.Nodes) <= 2*(height+2), "%d nodes for height %d", len(witness.Nodes), height)
+
+		partial, err := NewMutableTreeFromWitness(witness, root, version)
+		require.NoError(err)
+		_, partialValue := partial.Get(key)
+		require.Equal(value, partialValue)
+	}
+}
+
+func TestTracingConcurrentReads(t *testing.T) {
+	require := require.New(t)
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	keys := [][]byte{}
+	for i := 0; i < 200; i++ {
+		key := randBytes(4)
+		keys = append(keys, key)
+		tree.Set(key, key)
+	}
+	root, version, err := tree.SaveVersion()
+	require.NoError(err)
+	itree, err := tree.GetImmutable(version)
+	require.NoError(err)
+
+	// Tracing starts and stops while the tree is read.
+	done := make(chan struct{})
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := i; ; j++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				itree.Get(keys[j%len(keys)])
+			}
+		}(i)
+	}
+	for i := 0; i < 20; i++ {
+		itree.StartTracing()
+		_, value := itree.Get(keys[i])
+		witness := itree.StopTracing()
+		partial, err := NewMutableTreeFromWitness(witness, root, version)
+		require.NoError(err)
+		_, partialValue := partial.Get(keys[i])
+		require.Equal(value, partialValue)
+	}
+	close(done)
+	wg.Wait()
+}